@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/version"
+	"github.com/go-resty/resty"
+	"github.com/pkg/errors"
+)
+
+// default timeouts of the Kamatera API client, in seconds
+const (
+	defaultAPITimeout             = 120
+	defaultAPIDialTimeout         = 30
+	defaultAPITLSHandshakeTimeout = 30
+)
+
+// UserAgent is sent on all Kamatera API requests, it allows Kamatera support to identify the driver version
+func UserAgent() string {
+	return fmt.Sprintf("docker-machine-driver-kamatera/%s (libmachine/%s; %s/%s)", GetVersion(), version.Version, runtime.GOOS, runtime.GOARCH)
+}
+
+func getTimeoutDuration(seconds int, defaultSeconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// loadCAFile returns the system cert pool with the certificates from the given PEM file appended
+func loadCAFile(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to read --%s", flagAPICAFile))
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("No PEM certificates found in --%s %s", flagAPICAFile, caFile))
+	}
+	return pool, nil
+}
+
+// newHTTPClient creates the HTTP client used for all Kamatera API calls
+// the proxy is taken from the HTTPS_PROXY / HTTP_PROXY / NO_PROXY env vars
+func (d *Driver) newHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if d.APICAFile != "" {
+		pool, err := loadCAFile(d.APICAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	dialer := &net.Dialer{
+		Timeout:   getTimeoutDuration(d.APIDialTimeout, defaultAPIDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   getTimeoutDuration(d.APITLSHandshakeTimeout, defaultAPITLSHandshakeTimeout),
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: d.newRateLimitedTransport(transport),
+		Timeout:   getTimeoutDuration(d.APITimeout, defaultAPITimeout),
+	}, nil
+}
+
+// getHTTPClient returns the driver's HTTP client, it is created once and reused so that connections are kept alive
+// IsDialError returns true if the request failed to connect, so the request was not sent to the Kamatera API
+func IsDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+func (d *Driver) getHTTPClient() *http.Client {
+	if d.httpClient == nil {
+		httpClient, err := d.newHTTPClient()
+		if err != nil {
+			log.Errorf("Failed to configure the Kamatera API client, using the default settings: %s", err)
+			httpClient = &http.Client{
+				Transport: d.newRateLimitedTransport(http.DefaultTransport),
+				Timeout:   getTimeoutDuration(d.APITimeout, defaultAPITimeout),
+			}
+		}
+		d.httpClient = httpClient
+		d.client = resty.NewWithClient(httpClient).SetHeader("User-Agent", UserAgent())
+	}
+	return d.httpClient
+}
+
+// newRequest returns a Kamatera API request bound to the driver's HTTP client and context
+func (d *Driver) newRequest() *resty.Request {
+	d.getHTTPClient()
+	return d.client.R().SetContext(d.getContext())
+}
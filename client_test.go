@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsDialError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	_, err = client.Get("http://" + addr)
+	if err == nil || !IsDialError(err) {
+		t.Fatalf("expected a dial error, got %v", err)
+	}
+	if IsDialError(errors.New("unexpected EOF")) {
+		t.Fatal("unexpected dial error")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/machine/libmachine/auth"
+	"github.com/docker/machine/libmachine/cert"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/engine"
+	"github.com/docker/machine/libmachine/host"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/persist"
+	"github.com/docker/machine/libmachine/swarm"
+	mcnversion "github.com/docker/machine/libmachine/version"
+	"github.com/pkg/errors"
+)
+
+const clusterUsage = `Usage: docker-machine-driver-kamatera cluster create --count N --prefix PREFIX [OPTIONS]
+
+Create N Kamatera machines named PREFIX-1 .. PREFIX-N in the same datacenter and private network.
+The create options are validated once, distinct private network IPs are allocated to the machines
+and the servers are created in parallel. A docker-machine config directory is written for each machine,
+which is then provisioned using docker-machine provision.
+
+Options:
+`
+
+// stringSliceValue is a repeatable string flag
+type stringSliceValue []string
+
+func (s *stringSliceValue) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceValue) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// clusterDriverOptions implements drivers.DriverOptions for the driver flags parsed by the cluster command
+type clusterDriverOptions struct {
+	values map[string]interface{}
+}
+
+func (o *clusterDriverOptions) String(key string) string {
+	if v, ok := o.values[key].(*string); ok {
+		return *v
+	}
+	return ""
+}
+
+func (o *clusterDriverOptions) StringSlice(key string) []string {
+	if v, ok := o.values[key].(*stringSliceValue); ok {
+		return *v
+	}
+	return nil
+}
+
+func (o *clusterDriverOptions) Int(key string) int {
+	if v, ok := o.values[key].(*int); ok {
+		return *v
+	}
+	return 0
+}
+
+func (o *clusterDriverOptions) Bool(key string) bool {
+	if v, ok := o.values[key].(*bool); ok {
+		return *v
+	}
+	return false
+}
+
+// addDriverFlags registers the driver create flags, using the env vars as defaults like docker-machine does
+func addDriverFlags(fs *flag.FlagSet, createFlags []mcnflag.Flag) *clusterDriverOptions {
+	opts := &clusterDriverOptions{values: map[string]interface{}{}}
+	for _, f := range createFlags {
+		switch f := f.(type) {
+		case mcnflag.StringFlag:
+			value := f.Value
+			if env := os.Getenv(f.EnvVar); f.EnvVar != "" && env != "" {
+				value = env
+			}
+			opts.values[f.Name] = fs.String(f.Name, value, f.Usage)
+		case mcnflag.IntFlag:
+			value := f.Value
+			if env, err := strconv.Atoi(os.Getenv(f.EnvVar)); f.EnvVar != "" && err == nil {
+				value = env
+			}
+			opts.values[f.Name] = fs.Int(f.Name, value, f.Usage)
+		case mcnflag.BoolFlag:
+			value := false
+			if env, err := strconv.ParseBool(os.Getenv(f.EnvVar)); f.EnvVar != "" && err == nil {
+				value = env
+			}
+			opts.values[f.Name] = fs.Bool(f.Name, value, f.Usage)
+		case mcnflag.StringSliceFlag:
+			value := &stringSliceValue{}
+			if env := os.Getenv(f.EnvVar); f.EnvVar != "" && env != "" {
+				*value = strings.Split(env, ",")
+			} else {
+				*value = append(*value, f.Value...)
+			}
+			fs.Var(value, f.Name, f.Usage)
+			opts.values[f.Name] = value
+		}
+	}
+	return opts
+}
+
+func getDefaultStoragePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+	return filepath.Join(home, ".docker", "machine")
+}
+
+// newClusterHost returns the docker-machine host of a machine created by the cluster command,
+// with the default host options of docker-machine create
+func newClusterHost(d *Driver) *host.Host {
+	certsPath := filepath.Join(d.StorePath, "certs")
+	machinePath := d.ResolveStorePath(".")
+	return &host.Host{
+		ConfigVersion: mcnversion.ConfigVersion,
+		Driver:        d,
+		DriverName:    d.DriverName(),
+		Name:          d.MachineName,
+		HostOptions: &host.Options{
+			AuthOptions: &auth.Options{
+				CertDir:          certsPath,
+				CaCertPath:       filepath.Join(certsPath, "ca.pem"),
+				CaPrivateKeyPath: filepath.Join(certsPath, "ca-key.pem"),
+				ClientCertPath:   filepath.Join(certsPath, "cert.pem"),
+				ClientKeyPath:    filepath.Join(certsPath, "key.pem"),
+				ServerCertPath:   filepath.Join(machinePath, "server.pem"),
+				ServerKeyPath:    filepath.Join(machinePath, "server-key.pem"),
+				StorePath:        machinePath,
+			},
+			EngineOptions: &engine.Options{
+				InstallURL: drivers.DefaultEngineInstallURL,
+				TLSVerify:  true,
+			},
+			SwarmOptions: &swarm.Options{
+				Host:     "tcp://0.0.0.0:3376",
+				Image:    "swarm:latest",
+				Strategy: "spread",
+			},
+		},
+	}
+}
+
+// saveClusterHost saves the docker-machine config.json of the machine
+func saveClusterHost(d *Driver) error {
+	h := newClusterHost(d)
+	authOptions := h.HostOptions.AuthOptions
+	return persist.NewFilestore(d.StorePath, authOptions.CaCertPath, authOptions.CaPrivateKeyPath).Save(h)
+}
+
+// newClusterNode returns a copy of the validated driver for another machine in the cluster
+func newClusterNode(template *Driver, machineName string) *Driver {
+	node := *template
+	node.BaseDriver = &drivers.BaseDriver{
+		SSHUser:        template.SSHUser,
+		SSHPort:        template.SSHPort,
+		MachineName:    machineName,
+		StorePath:      template.StorePath,
+		SwarmMaster:    template.SwarmMaster,
+		SwarmHost:      template.SwarmHost,
+		SwarmDiscovery: template.SwarmDiscovery,
+	}
+	// the maps and slices are copied, so that changes to a node don't affect the other nodes
+	node.Datacenters = append([]string(nil), template.Datacenters...)
+	node.PrivateNetworkDns = append([]string(nil), template.PrivateNetworkDns...)
+	node.FirewallAllow = append([]string(nil), template.FirewallAllow...)
+	if template.Tags != nil {
+		node.Tags = map[string]string{}
+		for k, v := range template.Tags {
+			node.Tags[k] = v
+		}
+	}
+	if template.ServerOptions != nil {
+		node.ServerOptions = map[string]interface{}{}
+		for k, v := range template.ServerOptions {
+			node.ServerOptions[k] = v
+		}
+	}
+	node.ServerName = ""
+	node.Password = ""
+	node.PrivateNetworkIps = nil
+	return &node
+}
+
+// assignClusterPrivateNetworkIps allocates distinct private network IPs to the nodes
+// the remaining IPs are split between the nodes, so that retries with a different IP can't collide
+func assignClusterPrivateNetworkIps(nodes []*Driver) error {
+	first := nodes[0]
+	if first.PrivateNetworkName == "" || first.PrivateNetworkIp == privateNetworkIpAuto {
+		return nil
+	}
+	if len(nodes) > 1 && len(first.PrivateNetworkIps) == 0 {
+		return errors.New(fmt.Sprintf("Not enough available IPs in private network %s for %d machines (--%s can't be used with multiple machines)", first.PrivateNetworkName, len(nodes), flagPrivateNetworkIp))
+	}
+	ips := first.PrivateNetworkIps
+	first.PrivateNetworkIps = nil
+	for _, node := range nodes[1:] {
+		if len(ips) == 0 {
+			return errors.New(fmt.Sprintf("Not enough available IPs in private network %s for %d machines", first.PrivateNetworkName, len(nodes)))
+		}
+		node.PrivateNetworkIp, ips = ips[0], ips[1:]
+	}
+	for i, ip := range ips {
+		node := nodes[i%len(nodes)]
+		node.PrivateNetworkIps = append(node.PrivateNetworkIps, ip)
+	}
+	return nil
+}
+
+func runClusterCreate(args []string) error {
+	fs := flag.NewFlagSet("cluster create", flag.ContinueOnError)
+	count := fs.Int("count", 0, "Number of machines to create")
+	prefix := fs.String("prefix", "", "Machine name prefix, machines are named PREFIX-1 .. PREFIX-N")
+	concurrency := fs.Int("concurrency", 3, "Maximum number of machines to create in parallel")
+	storagePath := fs.String("storage-path", getDefaultStoragePath(), "docker-machine storage path (MACHINE_STORAGE_PATH)")
+	provision := fs.Bool("provision", true, "Run docker-machine provision on the created machines")
+	opts := addDriverFlags(fs, NewDriver().GetCreateFlags())
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, clusterUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 || *prefix == "" {
+		fs.Usage()
+		return errors.New("--count and --prefix are required")
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+	var names []string
+	for i := 1; i <= *count; i++ {
+		name := fmt.Sprintf("%s-%d", *prefix, i)
+		if _, err := os.Stat(filepath.Join(*storagePath, "machines", name)); err == nil {
+			return errors.New(fmt.Sprintf("Machine %s already exists", name))
+		}
+		names = append(names, name)
+	}
+
+	template := NewDriver()
+	template.ctx = HandleSignals()
+	template.MachineName = names[0]
+	template.StorePath = *storagePath
+	if err := template.SetConfigFromFlags(opts); err != nil {
+		return err
+	}
+	// the certificates are created once, before the machines are created in parallel
+	if err := cert.BootstrapCertificates(newClusterHost(template).HostOptions.AuthOptions); err != nil {
+		return errors.Wrap(err, "Failed to create the docker-machine certificates")
+	}
+	if err := template.PreCreateCheck(); err != nil {
+		return err
+	}
+	// create the private network once, so that all the nodes get IPs from it
+	if err := template.createMissingPrivateNetwork(); err != nil {
+		return err
+	}
+	// all the nodes use the validated datacenter, a node which falls back to another datacenter
+	// would not be in the same private network as the other nodes
+	template.Datacenters = []string{template.Datacenter}
+	nodes := []*Driver{template}
+	for _, name := range names[1:] {
+		nodes = append(nodes, newClusterNode(template, name))
+	}
+	if err := assignClusterPrivateNetworkIps(nodes); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, *concurrency)
+	createErrors := make([]error, len(nodes))
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Driver) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			log.Infof("(%s) Creating Kamatera machine", node.MachineName)
+			if err := os.MkdirAll(node.ResolveStorePath("."), 0700); err != nil {
+				createErrors[i] = err
+				return
+			}
+			// the machine is saved before the create like docker-machine create does, so that a failed machine can be removed with docker-machine rm
+			if err := saveClusterHost(node); err != nil {
+				createErrors[i] = err
+				return
+			}
+			createErrors[i] = node.Create()
+			// save the server name, ID and IPs which were set by the create, also if it failed
+			if err := saveClusterHost(node); err != nil && createErrors[i] == nil {
+				createErrors[i] = err
+			}
+		}(i, node)
+	}
+	wg.Wait()
+
+	var created []string
+	var failed []string
+	for i, node := range nodes {
+		if createErrors[i] != nil {
+			log.Errorf("(%s) Failed to create machine: %s", node.MachineName, createErrors[i])
+			failed = append(failed, node.MachineName)
+		} else {
+			log.Infof("(%s) Created Kamatera server %s (IP %s, private network IP %s)", node.MachineName, node.ServerName, node.IPAddress, node.PrivateNetworkIp)
+			created = append(created, node.MachineName)
+		}
+	}
+	if len(created) > 0 {
+		provisionArgs := append([]string{"--storage-path", *storagePath, "provision"}, created...)
+		if _, err := exec.LookPath("docker-machine"); *provision && err == nil {
+			log.Infof("Provisioning machines: %s", strings.Join(created, " "))
+			cmd := exec.Command("docker-machine", provisionArgs...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return errors.Wrap(err, "Failed to provision the machines")
+			}
+		} else {
+			log.Infof("To complete the docker installation, run: docker-machine %s", strings.Join(provisionArgs, " "))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("Failed to create %d of %d machines: %s (remove them with: docker-machine --storage-path %s rm %s)", len(failed), len(nodes), strings.Join(failed, " "), *storagePath, strings.Join(failed, " ")))
+	}
+	return nil
+}
+
+// RunClusterCommand runs the cluster companion command, returns the process exit code
+func RunClusterCommand(args []string) int {
+	if len(args) < 1 || args[0] != "create" {
+		fmt.Fprint(os.Stderr, clusterUsage)
+		return 1
+	}
+	if err := runClusterCreate(args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+		return 1
+	}
+	return 0
+}
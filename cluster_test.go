@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/machine/libmachine/cert"
+	"github.com/docker/machine/libmachine/persist"
+)
+
+func TestNewClusterNodeCopiesMapsAndSlices(t *testing.T) {
+	template := NewDriver()
+	template.MachineName = "cluster-1"
+	template.Datacenters = []string{"EU", "US-NY2"}
+	template.FirewallAllow = []string{"tcp:22:10.0.0.0/8"}
+	template.PrivateNetworkDns = []string{"8.8.8.8"}
+	template.Tags = map[string]string{"team": "ci"}
+	node := newClusterNode(template, "cluster-2")
+	node.Datacenters[0] = "IL"
+	node.FirewallAllow[0] = "tcp:2376:0.0.0.0/0"
+	node.PrivateNetworkDns[0] = "1.1.1.1"
+	node.Tags["team"] = "ops"
+	if template.Datacenters[0] != "EU" || template.FirewallAllow[0] != "tcp:22:10.0.0.0/8" || template.PrivateNetworkDns[0] != "8.8.8.8" || template.Tags["team"] != "ci" {
+		t.Fatalf("changing the node changed the template: %+v", template)
+	}
+	if node.MachineName != "cluster-2" || template.MachineName != "cluster-1" {
+		t.Fatalf("unexpected machine names: %s, %s", template.MachineName, node.MachineName)
+	}
+}
+
+func TestSaveClusterHost(t *testing.T) {
+	storePath := t.TempDir()
+	d := NewDriver()
+	d.MachineName = "cluster-1"
+	d.StorePath = storePath
+	d.IPAddress = "192.0.2.10"
+	d.ServerName = "cluster-1-abcd"
+	authOptions := newClusterHost(d).HostOptions.AuthOptions
+	if err := cert.BootstrapCertificates(authOptions); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{authOptions.CaCertPath, authOptions.CaPrivateKeyPath, authOptions.ClientCertPath, authOptions.ClientKeyPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("certificate was not created: %s", err)
+		}
+	}
+	if err := saveClusterHost(d); err != nil {
+		t.Fatal(err)
+	}
+	h, err := persist.NewFilestore(storePath, authOptions.CaCertPath, authOptions.CaPrivateKeyPath).Load("cluster-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.DriverName != "kamatera" || h.HostOptions.AuthOptions.StorePath != filepath.Join(storePath, "machines", "cluster-1") {
+		t.Fatalf("unexpected host: %s %+v", h.DriverName, h.HostOptions.AuthOptions)
+	}
+	loaded := NewDriver()
+	if err := json.Unmarshal(h.RawDriver, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IPAddress != d.IPAddress || loaded.ServerName != d.ServerName || loaded.MachineName != d.MachineName {
+		t.Fatalf("unexpected driver config: %+v", loaded)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	processContext     context.Context
+	processContextOnce sync.Once
+)
+
+// HandleSignals returns a context which is cancelled when the plugin process receives SIGINT or SIGTERM
+// the driver operations stop waiting and return, so that the create can be resumed or cleaned up later
+func HandleSignals() context.Context {
+	processContextOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			log.Infof("Received %s, cancelling Kamatera operations...", sig)
+			cancel()
+		}()
+		processContext = ctx
+	})
+	return processContext
+}
+
+func (d *Driver) getContext() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// sleep waits for the given duration, returns an error if the driver context was cancelled
+func (d *Driver) sleep(duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-d.getContext().Done():
+		return d.getContext().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func isContextCancelled(ctx context.Context) bool {
+	return ctx.Err() != nil
+}
+
+// dialSSH connects to an SSH server, the connection is closed when the context is cancelled
+// the timeout applies to the TCP connection and to the SSH handshake
+func dialSSH(ctx context.Context, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		close(done)
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	return client, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// CreateServerDisk is a server disk, the first disk is the OS disk which uses the disk image as source
+type CreateServerDisk struct {
+	SizeGB int
+	Source string
+}
+
+// CreateServerNetwork is a server NIC, the first NIC is the public "wan" network
+type CreateServerNetwork struct {
+	Name string
+	Ip   string
+}
+
+// CreateServerRequest is the form-encoded body of the Kamatera create server request
+type CreateServerRequest struct {
+	Datacenter string
+	Name       string
+	Password   string
+	Cpu        string
+	Ram        int
+	Billing    string
+	Traffic    string
+	Disks      []CreateServerDisk
+	Networks   []CreateServerNetwork
+	Power      bool
+	Managed    bool
+	Backup     bool
+	Script     string
+	Tag        string
+	Notes      string
+}
+
+// Values returns the request form fields, optional fields are omitted when empty
+func (r *CreateServerRequest) Values() url.Values {
+	values := url.Values{}
+	values.Set("datacenter", r.Datacenter)
+	values.Set("name", r.Name)
+	values.Set("password", r.Password)
+	values.Set("cpu", r.Cpu)
+	values.Set("ram", strconv.Itoa(r.Ram))
+	values.Set("billing", r.Billing)
+	values.Set("traffic", r.Traffic)
+	for i, disk := range r.Disks {
+		values.Set(fmt.Sprintf("disk_size_%d", i), strconv.Itoa(disk.SizeGB))
+		if disk.Source != "" {
+			values.Set(fmt.Sprintf("disk_src_%d", i), disk.Source)
+		}
+	}
+	for i, network := range r.Networks {
+		values.Set(fmt.Sprintf("network_name_%d", i), network.Name)
+		if network.Ip != "" {
+			values.Set(fmt.Sprintf("network_ip_%d", i), network.Ip)
+		}
+	}
+	values.Set("power", strconv.Itoa(BoolToFormValue(r.Power)))
+	values.Set("managed", strconv.Itoa(BoolToFormValue(r.Managed)))
+	values.Set("backup", strconv.Itoa(BoolToFormValue(r.Backup)))
+	if r.Script != "" {
+		values.Set("script_file", r.Script)
+	}
+	if r.Tag != "" {
+		values.Set("tag", r.Tag)
+	}
+	if r.Notes != "" {
+		values.Set("notes", r.Notes)
+	}
+	return values
+}
+
+// Encode returns the application/x-www-form-urlencoded body, sorted by field name
+func (r *CreateServerRequest) Encode() string {
+	return r.Values().Encode()
+}
+
+// getCreateServerRequest returns the create server request of the driver options
+func (d *Driver) getCreateServerRequest(serverPassword string, privateNetworkIp string) *CreateServerRequest {
+	req := &CreateServerRequest{
+		Datacenter: d.Datacenter,
+		Name:       d.ServerName,
+		Password:   serverPassword,
+		Cpu:        d.Cpu,
+		Ram:        d.Ram,
+		Billing:    d.Billing,
+		Traffic:    d.Traffic,
+		Disks:      []CreateServerDisk{{SizeGB: d.DiskSize, Source: d.DiskImageId}},
+		Networks:   []CreateServerNetwork{{Name: "wan"}},
+		Power:      true,
+		Managed:    d.Managed,
+		Backup:     d.Backup,
+		Tag:        d.GetTagsString(),
+		Notes:      d.Notes,
+	}
+	if d.PrivateNetworkName != "" {
+		req.Networks = append(req.Networks, CreateServerNetwork{Name: d.PrivateNetworkName, Ip: privateNetworkIp})
+	}
+	return req
+}
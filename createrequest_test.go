@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// assertGolden compares the actual value with testdata/<name>.golden, run go test -update to update the golden files
+func assertGolden(t *testing.T, name string, actual string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != string(expected) {
+		t.Errorf("%s does not match the golden file\nexpected: %s\nactual:   %s", name, expected, actual)
+	}
+}
+
+func TestCreateServerRequestEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		req  CreateServerRequest
+	}{
+		{
+			name: "minimal",
+			req: CreateServerRequest{
+				Datacenter: "EU",
+				Name:       "my-machine-abc123",
+				Password:   "Passw0rd",
+				Cpu:        "1B",
+				Ram:        1024,
+				Billing:    "hourly",
+				Disks:      []CreateServerDisk{{SizeGB: 10, Source: "EU:6000C29a5a7220dcf84716e7bef74f2c"}},
+				Networks:   []CreateServerNetwork{{Name: "wan"}},
+				Power:      true,
+			},
+		},
+		{
+			name: "special-characters",
+			req: CreateServerRequest{
+				Datacenter: "EU-FR",
+				Name:       "team a&b+c",
+				Password:   "p+a&s s=w%rd?#",
+				Cpu:        "2A",
+				Ram:        2048,
+				Billing:    "monthly",
+				Traffic:    "t5000",
+				Disks:      []CreateServerDisk{{SizeGB: 20, Source: "EU-FR:abc/def"}},
+				Networks:   []CreateServerNetwork{{Name: "wan"}},
+				Power:      true,
+				Tag:        "cost center=r&d,team=a+b",
+				Notes:      "created by ci\nowner: ops@example.com",
+			},
+		},
+		{
+			name: "all-fields",
+			req: CreateServerRequest{
+				Datacenter: "EU",
+				Name:       "build-1",
+				Password:   "Passw0rd",
+				Cpu:        "4B",
+				Ram:        8192,
+				Billing:    "hourly",
+				Disks: []CreateServerDisk{
+					{SizeGB: 50, Source: "EU:image"},
+					{SizeGB: 100},
+					{SizeGB: 200},
+				},
+				Networks: []CreateServerNetwork{
+					{Name: "wan"},
+					{Name: "lan-build", Ip: "172.16.0.10"},
+					{Name: "lan-storage", Ip: "auto"},
+				},
+				Power:   true,
+				Managed: true,
+				Backup:  true,
+				Script:  "#!/bin/bash\necho hello > /tmp/hello",
+				Tag:     "team=build",
+				Notes:   "build cluster",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := test.req.Encode()
+			assertGolden(t, "create_server_request_"+test.name, encoded)
+			decoded, err := url.ParseQuery(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.req.Values()) {
+				t.Errorf("decoded request does not match the request values\nexpected: %v\nactual:   %v", test.req.Values(), decoded)
+			}
+		})
+	}
+}
+
+func TestDriverCreateServerRequest(t *testing.T) {
+	d := NewDriver()
+	d.ServerName = "my-machine"
+	d.DiskImageId = "EU:6000C29a5a7220dcf84716e7bef74f2c"
+	d.PrivateNetworkName = "lan-1"
+	d.Tags = map[string]string{"team": "a", "env": "ci"}
+	d.Notes = "notes"
+	d.Backup = true
+	encoded := d.getCreateServerRequest("secret&password", "172.16.0.5").Encode()
+	assertGolden(t, "create_server_request_driver", encoded)
+	if strings.Contains(encoded, "secret&password") {
+		t.Errorf("password is not form-encoded: %s", encoded)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// error messages from Kamatera which indicate that the datacenter can't create the server right now
+var capacityErrorPatterns = []string{
+	"capacity",
+	"insufficient resources",
+	"not enough resources",
+	"no available resources",
+	"out of resources",
+	"out of stock",
+	"no available host",
+}
+
+// KamateraCapacityError is returned when a create fails because the datacenter has no capacity
+type KamateraCapacityError struct {
+	Datacenter string
+	Message    string
+}
+
+func (e *KamateraCapacityError) Error() string {
+	return fmt.Sprintf("Kamatera datacenter %s has no capacity for the server: %s", e.Datacenter, e.Message)
+}
+
+func IsCapacityErrorMessage(message string) bool {
+	message = strings.ToLower(message)
+	for _, pattern := range capacityErrorPatterns {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func IsCapacityError(err error) bool {
+	_, ok := errors.Cause(err).(*KamateraCapacityError)
+	return ok
+}
+
+// ParseDatacenters parses an ordered, comma-separated list of datacenters
+func ParseDatacenters(value string) ([]string, error) {
+	var datacenters []string
+	for _, datacenter := range strings.Split(value, ",") {
+		datacenter = strings.TrimSpace(datacenter)
+		if datacenter == "" {
+			continue
+		}
+		if IsStringInArray(datacenter, datacenters) {
+			return nil, errors.New(fmt.Sprintf("Duplicate datacenter: %s", datacenter))
+		}
+		datacenters = append(datacenters, datacenter)
+	}
+	if len(datacenters) == 0 {
+		return nil, errors.Errorf("kamatera requires --%v to be set", flagDatacenter)
+	}
+	return datacenters, nil
+}
+
+// getNextDatacenters returns the datacenters after the current one in the fallback list
+func (d *Driver) getNextDatacenters() []string {
+	for i, datacenter := range d.Datacenters {
+		if datacenter == d.Datacenter {
+			return d.Datacenters[i+1:]
+		}
+	}
+	return nil
+}
+
+// useNextDatacenter switches to the next datacenter which passes validation
+// returns the capacity error if there are no more datacenters to try
+func (d *Driver) useNextDatacenter(capacityErr error) error {
+	nextDatacenters := d.getNextDatacenters()
+	if len(nextDatacenters) == 0 {
+		return capacityErr
+	}
+	res, err := d.getServerOptions()
+	if err != nil {
+		return err
+	}
+	previousDatacenter := d.Datacenter
+	for _, datacenter := range nextDatacenters {
+		log.Infof("Datacenter %s has no capacity, trying datacenter %s", previousDatacenter, datacenter)
+		d.Datacenter = datacenter
+		d.DatacenterName = ""
+		d.DiskImageId = ""
+		d.Traffic = d.requestedTraffic
+		d.TrafficDescription = ""
+		d.PrivateNetworkIp = d.requestedPrivateNetworkIp
+		d.PrivateNetworkIps = nil
+		d.CreateServerCommandId = 0
+		d.IPAddress = ""
+		if err := d.validateDatacenter(res); err != nil {
+			log.Infof("Skipping datacenter %s: %s", datacenter, err)
+			previousDatacenter = datacenter
+			continue
+		}
+		d.emitEventf(eventValidated, "create options validated for datacenter %s", datacenter)
+		return nil
+	}
+	return errors.Wrap(capacityErr, fmt.Sprintf("No other datacenter is available (tried %s)", strings.Join(d.Datacenters, ",")))
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// KamateraSchemaDriftError is returned when a Kamatera response is missing fields which the caller reads
+type KamateraSchemaDriftError struct {
+	Operation string
+	Missing   []string
+}
+
+func (e *KamateraSchemaDriftError) Error() string {
+	return fmt.Sprintf("Kamatera %s response is missing fields: %s (the Kamatera API may have changed, please upgrade docker-machine-driver-kamatera or report an issue)", e.Operation, strings.Join(e.Missing, ", "))
+}
+
+// SchemaDrift lists the differences between a JSON document and the struct it is decoded into
+// paths use [] for array items and {} for map values, e.g. diskImages{}[].id
+type SchemaDrift struct {
+	Unknown []string
+	Missing []string
+}
+
+type jsonField struct {
+	name     string
+	optional bool
+	typ      reflect.Type
+}
+
+// getJSONFields returns the JSON fields of a struct type, fields tagged with omitempty are optional
+func getJSONFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		optional := false
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, option := range parts[1:] {
+				if option == "omitempty" {
+					optional = true
+				}
+			}
+		}
+		fields = append(fields, jsonField{name: name, optional: optional, typ: field.Type})
+	}
+	return fields
+}
+
+// CheckSchemaDrift compares a decoded JSON value with the type it is decoded into
+// field names are matched case-insensitively, like encoding/json does
+func CheckSchemaDrift(raw interface{}, t reflect.Type) *SchemaDrift {
+	unknown := map[string]bool{}
+	missing := map[string]bool{}
+	checkSchemaDrift("", raw, t, unknown, missing)
+	drift := &SchemaDrift{}
+	for path := range unknown {
+		drift.Unknown = append(drift.Unknown, path)
+	}
+	for path := range missing {
+		drift.Missing = append(drift.Missing, path)
+	}
+	sort.Strings(drift.Unknown)
+	sort.Strings(drift.Missing)
+	return drift
+}
+
+func joinSchemaPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func checkSchemaDrift(path string, raw interface{}, t reflect.Type, unknown map[string]bool, missing map[string]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := getJSONFields(t)
+		for key, value := range object {
+			found := false
+			for _, field := range fields {
+				if strings.EqualFold(key, field.name) {
+					found = true
+					checkSchemaDrift(joinSchemaPath(path, field.name), value, field.typ, unknown, missing)
+					break
+				}
+			}
+			if !found {
+				unknown[joinSchemaPath(path, key)] = true
+			}
+		}
+		for _, field := range fields {
+			if field.optional {
+				continue
+			}
+			found := false
+			for key := range object {
+				if strings.EqualFold(key, field.name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing[joinSchemaPath(path, field.name)] = true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if items, ok := raw.([]interface{}); ok {
+			for _, item := range items {
+				checkSchemaDrift(path+"[]", item, t.Elem(), unknown, missing)
+			}
+		}
+	case reflect.Map:
+		if object, ok := raw.(map[string]interface{}); ok {
+			for _, value := range object {
+				checkSchemaDrift(path+"{}", value, t.Elem(), unknown, missing)
+			}
+		}
+	}
+}
+
+// schema drift warnings which were already logged, to warn once per operation instead of on every poll
+var loggedSchemaDrift sync.Map
+
+// DecodeKamateraResponse decodes a Kamatera JSON response and checks it for schema drift
+// unknown fields are logged, missing fields are logged as a warning and returned as a KamateraSchemaDriftError
+// only if they are listed in required, the fields which the caller reads (schema paths, e.g. [].name)
+func DecodeKamateraResponse(operation string, body []byte, v interface{}, required ...string) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Invalid JSON response from Kamatera %s", operation))
+	}
+	var raw interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Invalid JSON response from Kamatera %s", operation))
+	}
+	drift := CheckSchemaDrift(raw, reflect.TypeOf(v))
+	if len(drift.Unknown) > 0 {
+		log.Debugf("Kamatera %s response has unknown fields: %s", operation, strings.Join(drift.Unknown, ", "))
+	}
+	if len(drift.Missing) == 0 {
+		return nil
+	}
+	missing := strings.Join(drift.Missing, ", ")
+	if _, logged := loggedSchemaDrift.LoadOrStore(operation+": "+missing, true); logged {
+		log.Debugf("Kamatera %s response is missing fields: %s", operation, missing)
+	} else {
+		log.Warnf("Kamatera %s response is missing fields: %s (the Kamatera API may have changed, please upgrade docker-machine-driver-kamatera or report an issue)", operation, missing)
+	}
+	var missingRequired []string
+	for _, path := range drift.Missing {
+		if IsStringInArray(path, required) {
+			missingRequired = append(missingRequired, path)
+		}
+	}
+	if len(missingRequired) > 0 {
+		return &KamateraSchemaDriftError{Operation: operation, Missing: missingRequired}
+	}
+	return nil
+}
+
+// the server options fields which are read to validate the create options
+var serverOptionsRequiredFields = []string{"datacenters", "cpu", "disk", "billing", "diskImages", "diskImages{}[].id", "diskImages{}[].description"}
+
+// ParseServerOptions parses the server options response, required lists the fields which the caller reads
+func ParseServerOptions(body []byte, required ...string) (*KamateraServerOptions, error) {
+	var res KamateraServerOptions
+	if err := DecodeKamateraResponse("server options", body, &res, required...); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ParseServerList parses the servers list response, required lists the fields which the caller reads
+func ParseServerList(body []byte, required ...string) ([]KamateraServerListInfo, error) {
+	var servers []KamateraServerListInfo
+	if err := DecodeKamateraResponse("servers", body, &servers, required...); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// ParseCommandInfo parses a queue command response
+func ParseCommandInfo(operation string, body []byte) (*KamateraServerCommandInfo, error) {
+	var res KamateraServerCommandInfo
+	if err := DecodeKamateraResponse(operation, body, &res, "status"); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// errNoCreateServerCommandId is returned for an empty create server response, the server may have been created so it's not retried
+var errNoCreateServerCommandId = errors.New("Kamatera create server response does not contain a command ID")
+
+// ParseCreateServerResponse returns the create server command ID
+func ParseCreateServerResponse(body []byte) (int, error) {
+	var commandIds []int
+	if err := DecodeKamateraResponse("create server", body, &commandIds); err != nil {
+		return 0, err
+	}
+	if len(commandIds) == 0 {
+		return 0, errNoCreateServerCommandId
+	}
+	return commandIds[0], nil
+}
+
+var commandLogIpPattern = regexp.MustCompile(`[0-9.]+`)
+
+// ParseCreateServerIp returns the first public IPv4 address in the create server command log
+// it is only used if the server info is not available, the log may also contain the gateway or DNS servers IPs
+func ParseCreateServerIp(commandLog string) (string, error) {
+	for _, match := range commandLogIpPattern.FindAllString(commandLog, -1) {
+		// a sentence may end with the IP, but version numbers like 1.2.3.4.5 are not IPs
+		ip := net.ParseIP(strings.TrimRight(match, ".")).To4()
+		if ip == nil || ip.IsUnspecified() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", errors.New("Failed to find the server IP in the Kamatera create server command log")
+}
+
+// FormatTrafficId formats a traffic option ID, which Kamatera returns either as a string or as a number
+func FormatTrafficId(id interface{}) (string, error) {
+	switch id := id.(type) {
+	case string:
+		return id, nil
+	case float64:
+		if id != math.Trunc(id) || math.IsInf(id, 0) || math.Abs(id) > 1e15 {
+			return "", errors.New(fmt.Sprintf("Invalid Kamatera traffic ID: %v", id))
+		}
+		return strconv.FormatInt(int64(id), 10), nil
+	default:
+		return "", errors.New(fmt.Sprintf("Invalid Kamatera traffic ID: %v", id))
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// the fuzz targets run the seed corpus with go test, run them with go test -fuzz FuzzParseServerOptions to fuzz
+
+func FuzzParseServerOptions(f *testing.F) {
+	f.Add([]byte(`{"datacenters":{"EU":"Amsterdam"},"cpu":["1B"],"disk":[10],"billing":["hourly","monthly"],"diskImages":{"EU":[{"id":"EU:1","description":"ubuntu_server_22.04_64-bit","sizeGB":10}]},"networks":{"EU":[{"name":"lan-1","ips":["172.16.0.2"]}]},"traffic":{"EU":[{"id":"t5000","info":"5TB"},{"id":5001,"info":"5TB"}]}}`))
+	f.Add([]byte(`{"datacenters":{"EU":"Amsterdam"},"cpu":["1B"],"disk":[10],"billing":["monthly"],"diskImages":{"EU":[]},"traffic":{"EU":[{"id":1.5,"info":""},{"id":null},{"id":[1]},{"id":{}}]}}`))
+	f.Add([]byte(`{"datacenters":null,"cpu":null,"disk":null,"billing":null,"diskImages":null}`))
+	f.Add([]byte(`{"diskImages":{"EU":[{"id":1}]}}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(``))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		res, err := ParseServerOptions(body)
+		if err != nil {
+			return
+		}
+		if res == nil {
+			t.Fatal("no error and no server options")
+		}
+		for datacenter := range res.Datacenters {
+			d := NewDriver()
+			d.Datacenter = datacenter
+			d.Cpu = "1B"
+			d.Ram = 1024
+			d.DiskSize = 10
+			d.Billing = "monthly"
+			d.validateDatacenter(res)
+		}
+	})
+}
+
+func FuzzParseServerList(f *testing.F) {
+	f.Add([]byte(`[{"id":"1","datacenter":"EU","name":"my-machine","power":"on"}]`))
+	f.Add([]byte(`[{"id":1,"datacenter":"EU","name":"my-machine","power":"on"}]`))
+	f.Add([]byte(`[{"name":"my-machine"},null,{}]`))
+	f.Add([]byte(`{"servers":[]}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(``))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		servers, err := ParseServerList(body)
+		if err != nil {
+			return
+		}
+		for _, server := range servers {
+			_ = server.Name
+		}
+	})
+}
+
+func FuzzParseCommandInfo(f *testing.F) {
+	f.Add([]byte(`{"status":"complete","log":"Server created\nIP: 185.1.2.3 \nDone\n"}`), 0)
+	f.Add([]byte(`{"status":"complete","log":"Network wan ip 1.2.3.4/24, lan 172.16.0.5\r\n"}`), 1)
+	f.Add([]byte(`{"status":"progress","log":"999.1.2.3 1.2.3.4.5 0.0.0.0"}`), 5)
+	f.Add([]byte(`{"status":"error","description":"out of resources"}`), 0)
+	f.Add([]byte(`{"status":1}`), 0)
+	f.Add([]byte(`{}`), -1)
+	f.Add([]byte(`null`), 0)
+	f.Fuzz(func(t *testing.T, body []byte, printedLines int) {
+		res, err := ParseCommandInfo("create server command", body)
+		if err != nil {
+			return
+		}
+		finished := res.Status == "complete" || res.Status == "error"
+		lines, printed := GetNewCommandLogLines(res.Log, printedLines, finished)
+		if printed < 0 || len(lines) > printed {
+			t.Fatalf("invalid log lines: %d new lines, %d printed lines", len(lines), printed)
+		}
+		ip, err := ParseCreateServerIp(res.Log)
+		if err == nil && !strings.Contains(res.Log, ip) {
+			t.Fatalf("IP %s is not in the log", ip)
+		}
+	})
+}
+
+func FuzzParseCreateServerResponse(f *testing.F) {
+	f.Add([]byte(`[12345]`))
+	f.Add([]byte(`[1,2]`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`[null]`))
+	f.Add([]byte(`["12345"]`))
+	f.Add([]byte(`{"message":"out of resources"}`))
+	f.Add([]byte(``))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		ParseCreateServerResponse(body)
+	})
+}
+
+func TestParseCreateServerResponse(t *testing.T) {
+	if commandId, err := ParseCreateServerResponse([]byte(`[12345]`)); err != nil || commandId != 12345 {
+		t.Errorf("expected command ID 12345, got %d (%v)", commandId, err)
+	}
+	for _, body := range []string{`[]`, `null`, `{}`, `["a"]`, ``} {
+		if _, err := ParseCreateServerResponse([]byte(body)); err == nil {
+			t.Errorf("expected an error for %q", body)
+		}
+	}
+}
+
+func TestDecodeKamateraResponseMissingFields(t *testing.T) {
+	// the servers list without the power field can still be used to find a server by name
+	body := []byte(`[{"id":"1","datacenter":"EU","name":"my-machine"}]`)
+	servers, err := ParseServerList(body, "[].id", "[].name")
+	if err != nil || len(servers) != 1 || servers[0].Name != "my-machine" {
+		t.Fatalf("expected the server, got %v (%v)", servers, err)
+	}
+	_, err = ParseServerList(body, "[].name", "[].power")
+	if drift, ok := err.(*KamateraSchemaDriftError); !ok || strings.Join(drift.Missing, ",") != "[].power" {
+		t.Fatalf("expected a schema drift error for [].power, got %v", err)
+	}
+	if _, err := ParseServerOptions([]byte(`{"datacenters":{"EU":"Amsterdam"},"cpu":["1B"],"disk":[10],"billing":["hourly"],"diskImages":{"EU":[{"id":"EU:1","description":"ubuntu"}]}}`), serverOptionsRequiredFields...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseServerOptions([]byte(`{"datacenters":{"EU":"Amsterdam"},"cpu":["1B"],"disk":[10],"billing":["hourly"],"diskImages":{"EU":[{"id":"EU:1"}]}}`), serverOptionsRequiredFields...); err == nil {
+		t.Fatal("expected a schema drift error for the missing image description")
+	}
+}
+
+func TestParseCreateServerIp(t *testing.T) {
+	tests := []struct {
+		log string
+		ip  string
+	}{
+		{"Server created\nIP: 185.1.2.3 \n", "185.1.2.3"},
+		{"wan ip 1.2.3.4/24", "1.2.3.4"},
+		{"version 1.2.3.4.5 then 999.1.2.3 then 185.1.2.3", "185.1.2.3"},
+		{"0.0.0.0 185.1.2.3", "185.1.2.3"},
+		{"lan 172.16.0.5, 10.0.0.1, 192.168.1.1, 127.0.0.1, 169.254.0.1 wan 185.1.2.3", "185.1.2.3"},
+		{"private network ip 172.16.0.5", ""},
+		{"no ip here", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		ip, err := ParseCreateServerIp(test.log)
+		if test.ip == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.log, ip)
+			}
+		} else if ip != test.ip || err != nil {
+			t.Errorf("%q: expected %s, got %s (%v)", test.log, test.ip, ip, err)
+		}
+	}
+}
+
+func TestFormatTrafficId(t *testing.T) {
+	for id, expected := range map[interface{}]string{"t5000": "t5000", float64(5000): "5000", float64(-1): "-1"} {
+		if actual, err := FormatTrafficId(id); err != nil || actual != expected {
+			t.Errorf("%v: expected %s, got %s (%v)", id, expected, actual, err)
+		}
+	}
+	for _, id := range []interface{}{nil, 1.5, true, []interface{}{}, map[string]interface{}{}, 1e300} {
+		if _, err := FormatTrafficId(id); err == nil {
+			t.Errorf("%v: expected an error", id)
+		}
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"net/http"
     "encoding/json"
     "strings"
-    "regexp"
     "bytes"
-    "net/url"
+    "sort"
+    "context"
+    "text/template"
 	"math/rand"
+	"os"
+	"path/filepath"
 
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
@@ -30,6 +33,7 @@ type Driver struct {
 	APIClientID string
 	APISecret string
 	Datacenter string
+	Datacenters []string
 	Billing string
 	Traffic string
 	TrafficDescription string
@@ -40,6 +44,33 @@ type Driver struct {
 	PrivateNetworkName string
 	PrivateNetworkIp string
 	PrivateNetworkIps []string
+	PrivateNetworkIpRange string
+	PrivateNetworkCreate bool
+	PrivateNetworkSubnet string
+	PrivateNetworkGateway string
+	PrivateNetworkDns []string
+	CheckCredentials bool
+	FirewallAllow []string
+	Tags map[string]string
+	Notes string
+	ServerNameTemplate string
+	OrphanedServer string
+	CleanupOnFailure bool
+	ExistingServer string
+	ExistingServerPassword string
+	ExistingServerSSHKey string
+	DryRun bool
+	Backup bool
+	Managed bool
+	APICAFile string
+	APITimeout int
+	APIDialTimeout int
+	APITLSHandshakeTimeout int
+	APIRateLimit int
+	APIRateLimitBurst int
+	APIRateLimitShared bool
+	SSHBootstrapTimeout int
+	SSHDialTimeout int
 
 	ServerOptions map[string]interface{}
 	ImageID string
@@ -49,6 +80,16 @@ type Driver struct {
 	Password string
 	KamateraServerId string
 	ServerName string
+
+	eventsStartedAt time.Time
+	ctx context.Context
+	requestedTraffic string
+	requestedPrivateNetworkIp string
+	privateNetworkMissing bool
+	createRequestSent time.Time
+	sshRetryInterval time.Duration
+	httpClient *http.Client
+	client *resty.Client
 }
 
 const (
@@ -57,7 +98,8 @@ const (
 	defaultCpu  = "1B"
 	defaultRam = 1024
 	defaultDiskSize = 10
-	defaultImage = "ubuntu_server_18.04_64-bit"
+	defaultImage = "ubuntu:22.04"
+	defaultServerNameTemplate = "{{.MachineName}}-{{.Random}}"
 
 	flagAPIClientID = "kamatera-api-client-id"
 	flagAPISecret = "kamatera-api-secret"
@@ -71,11 +113,43 @@ const (
 	flagCreateServerCommandId = "kamatera-create-server-command-id"
 	flagPrivateNetworkName = "kamatera-private-network-name"
 	flagPrivateNetworkIp = "kamatera-private-network-ip"
+	flagPrivateNetworkIpRange = "kamatera-private-network-ip-range"
+	flagPrivateNetworkCreate = "kamatera-private-network-create"
+	flagPrivateNetworkSubnet = "kamatera-private-network-subnet"
+	flagPrivateNetworkGateway = "kamatera-private-network-gateway"
+	flagPrivateNetworkDns = "kamatera-private-network-dns"
+	flagCheckCredentials = "kamatera-check-credentials"
+	flagFirewallAllow = "kamatera-firewall-allow"
+	flagTag = "kamatera-tag"
+	flagNotes = "kamatera-notes"
+	flagServerNameTemplate = "kamatera-server-name-template"
+	flagServerNameUseMachineName = "kamatera-server-name-use-machine-name"
+	flagOrphanedServer = "kamatera-orphaned-server"
+	flagCleanupOnFailure = "kamatera-cleanup-on-failure"
+	flagExistingServer = "kamatera-existing-server"
+	flagExistingServerPassword = "kamatera-existing-server-password"
+	flagExistingServerSSHKey = "kamatera-existing-server-ssh-key"
+	flagDryRun = "kamatera-dry-run"
+	flagBackup = "kamatera-backup"
+	flagManaged = "kamatera-managed"
+	flagAPICAFile = "kamatera-api-ca-file"
+	flagAPITimeout = "kamatera-api-timeout"
+	flagAPIDialTimeout = "kamatera-api-dial-timeout"
+	flagAPITLSHandshakeTimeout = "kamatera-api-tls-handshake-timeout"
+	flagAPIRateLimit = "kamatera-api-rate-limit"
+	flagAPIRateLimitBurst = "kamatera-api-rate-limit-burst"
+	flagAPIRateLimitShared = "kamatera-api-rate-limit-shared"
+	flagSSHPort = "kamatera-ssh-port"
+	flagSSHBootstrapTimeout = "kamatera-ssh-bootstrap-timeout"
+	flagSSHDialTimeout = "kamatera-ssh-dial-timeout"
+
+	redacted = "REDACTED"
 )
 
 func NewDriver() *Driver {
 	return &Driver{
 	    Datacenter: defaultDatacenter,
+	    Datacenters: []string{defaultDatacenter},
 	    Billing: defaultBilling,
 	    Traffic: "",
 	    TrafficDescription: "",
@@ -87,6 +161,15 @@ func NewDriver() *Driver {
 	    KamateraServerId: "",
 	    PrivateNetworkName: "",
 	    PrivateNetworkIp: "",
+	    ServerNameTemplate: defaultServerNameTemplate,
+	    OrphanedServer: orphanedServerAdopt,
+	    APITimeout: defaultAPITimeout,
+	    APIDialTimeout: defaultAPIDialTimeout,
+	    APITLSHandshakeTimeout: defaultAPITLSHandshakeTimeout,
+	    APIRateLimit: defaultAPIRateLimit,
+	    APIRateLimitBurst: defaultAPIRateLimitBurst,
+	    SSHBootstrapTimeout: defaultSSHBootstrapTimeout,
+	    SSHDialTimeout: defaultSSHDialTimeout,
 	    BaseDriver: &drivers.BaseDriver{
 			SSHUser: "root",
 			SSHPort: 22,
@@ -130,7 +213,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: "KAMATERA_DATACENTER",
 			Name:   flagDatacenter,
-			Usage:  "Kamatera datacenter",
+			Usage:  "Kamatera datacenter, or an ordered comma-separated list of datacenters to try if a datacenter has no capacity (e.g. EU,EU-FR,EU-LO)",
 			Value:  defaultDatacenter,
 		},
 		mcnflag.StringFlag{
@@ -166,7 +249,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: "KAMATERA_IMAGE",
 			Name:   flagImage,
-			Usage:  "Kamatera image name",
+			Usage:  "Kamatera image: an image description (e.g. ubuntu_server_22.04_64-bit), an OS[_FLAVOR]:VERSION selector (e.g. ubuntu:>=22.04, debian:latest, ubuntu_desktop:22.04) or id:IMAGE_ID",
 			Value:  defaultImage,
 		},
 		mcnflag.StringFlag{
@@ -178,16 +261,185 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: "KAMATERA_PRIVATE_NETWORK_IP",
 			Name:   flagPrivateNetworkIp,
-			Usage:  "Kamatera private network ip (optional)",
+			Usage:  "Kamatera private network ip (optional), by default a random available IP which is not used by other machines is allocated, use \"auto\" to let Kamatera choose the IP",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_PRIVATE_NETWORK_IP_RANGE",
+			Name:   flagPrivateNetworkIpRange,
+			Usage:  "Allocate the private network IP from this range, either a CIDR (e.g. 172.16.0.0/24) or FIRST-LAST (e.g. 172.16.0.10-172.16.0.50)",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_PRIVATE_NETWORK_CREATE",
+			Name:   flagPrivateNetworkCreate,
+			Usage:  "Create the private network if it does not exist, requires --kamatera-private-network-subnet",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_PRIVATE_NETWORK_SUBNET",
+			Name:   flagPrivateNetworkSubnet,
+			Usage:  "Subnet of the created private network (e.g. 172.16.0.0/23)",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_PRIVATE_NETWORK_GATEWAY",
+			Name:   flagPrivateNetworkGateway,
+			Usage:  "Gateway IP of the created private network (optional)",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "KAMATERA_PRIVATE_NETWORK_DNS",
+			Name:   flagPrivateNetworkDns,
+			Usage:  "DNS server IP of the created private network (optional, up to 2)",
+			Value:  []string{},
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_CHECK_CREDENTIALS",
+			Name:   flagCheckCredentials,
+			Usage:  "Only verify the Kamatera API credentials, without creating a server",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "KAMATERA_FIREWALL_ALLOW",
+			Name:   flagFirewallAllow,
+			Usage:  "Allow incoming traffic in the server firewall (protocol:port[:source], can be repeated), SSH and Docker ports are always allowed",
+			Value:  []string{},
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "KAMATERA_TAG",
+			Name:   flagTag,
+			Usage:  "Kamatera server tag in key=value format (can be repeated)",
+			Value:  []string{},
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_NOTES",
+			Name:   flagNotes,
+			Usage:  "Kamatera server notes",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_SERVER_NAME_TEMPLATE",
+			Name:   flagServerNameTemplate,
+			Usage:  "Kamatera server name template, available fields: MachineName, Datacenter, Cpu, Ram, Random",
+			Value:  defaultServerNameTemplate,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_SERVER_NAME_USE_MACHINE_NAME",
+			Name:   flagServerNameUseMachineName,
+			Usage:  "Use the machine name as the Kamatera server name",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_ORPHANED_SERVER",
+			Name:   flagOrphanedServer,
+			Usage:  "What to do with a server created by a previous failed create of this machine: adopt, terminate or fail",
+			Value:  orphanedServerAdopt,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_CLEANUP_ON_FAILURE",
+			Name:   flagCleanupOnFailure,
+			Usage:  "Terminate the Kamatera server if create fails after the server was created (enabled by default when the CI environment variable is set)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_EXISTING_SERVER",
+			Name:   flagExistingServer,
+			Usage:  "Name or ID of an existing Kamatera server to use instead of creating a new server",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_EXISTING_SERVER_PASSWORD",
+			Name:   flagExistingServerPassword,
+			Usage:  "Root password of the existing Kamatera server",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_EXISTING_SERVER_SSH_KEY",
+			Name:   flagExistingServerSSHKey,
+			Usage:  "Path to a private SSH key which is authorized for root on the existing Kamatera server",
 			Value:  "",
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_DRY_RUN",
+			Name:   flagDryRun,
+			Usage:  "Validate the create options and print the create server request and estimated price, without creating a server",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_BACKUP",
+			Name:   flagBackup,
+			Usage:  "Enable Kamatera daily backups of the server",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_MANAGED",
+			Name:   flagManaged,
+			Usage:  "Enable Kamatera managed services for the server",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_API_CA_FILE",
+			Name:   flagAPICAFile,
+			Usage:  "Path to a PEM file with additional CA certificates to trust for the Kamatera API (e.g. of a TLS intercepting proxy)",
+			Value:  "",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_API_TIMEOUT",
+			Name:   flagAPITimeout,
+			Usage:  "Timeout in seconds of each Kamatera API request, including reading the response",
+			Value:  defaultAPITimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_API_DIAL_TIMEOUT",
+			Name:   flagAPIDialTimeout,
+			Usage:  "Timeout in seconds for connecting to the Kamatera API",
+			Value:  defaultAPIDialTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_API_TLS_HANDSHAKE_TIMEOUT",
+			Name:   flagAPITLSHandshakeTimeout,
+			Usage:  "Timeout in seconds for the TLS handshake with the Kamatera API",
+			Value:  defaultAPITLSHandshakeTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_API_RATE_LIMIT",
+			Name:   flagAPIRateLimit,
+			Usage:  "Maximum number of Kamatera API requests per minute (0 = unlimited)",
+			Value:  defaultAPIRateLimit,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_API_RATE_LIMIT_BURST",
+			Name:   flagAPIRateLimitBurst,
+			Usage:  "Number of Kamatera API requests which may be sent at once before the rate limit applies",
+			Value:  defaultAPIRateLimitBurst,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_API_RATE_LIMIT_SHARED",
+			Name:   flagAPIRateLimitShared,
+			Usage:  "Share the Kamatera API rate limit between all docker-machine processes using the same store, using a lock file",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_SSH_PORT",
+			Name:   flagSSHPort,
+			Usage:  "SSH port of the server, used for the bootstrap and by docker-machine",
+			Value:  22,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_SSH_BOOTSTRAP_TIMEOUT",
+			Name:   flagSSHBootstrapTimeout,
+			Usage:  "Timeout in seconds for the server to be running and to copy the SSH key to it",
+			Value:  defaultSSHBootstrapTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_SSH_DIAL_TIMEOUT",
+			Name:   flagSSHDialTimeout,
+			Usage:  "Timeout in seconds of each SSH connection attempt during the bootstrap",
+			Value:  defaultSSHDialTimeout,
+		},
 	}
 }
 
 func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
     d.APIClientID = opts.String(flagAPIClientID)
 	d.APISecret = opts.String(flagAPISecret)
-	d.Datacenter = opts.String(flagDatacenter)
+	datacenters, err := ParseDatacenters(opts.String(flagDatacenter))
+	if err != nil {return err}
+	d.Datacenters = datacenters
+	d.Datacenter = datacenters[0]
 	d.Billing = opts.String(flagBilling)
 	d.Traffic = opts.String(flagTraffic)
 	d.Cpu = opts.String(flagCpu)
@@ -197,6 +449,40 @@ func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 	d.CreateServerCommandId = opts.Int(flagCreateServerCommandId)
 	d.PrivateNetworkName = opts.String(flagPrivateNetworkName)
 	d.PrivateNetworkIp = opts.String(flagPrivateNetworkIp)
+	d.PrivateNetworkIpRange = opts.String(flagPrivateNetworkIpRange)
+	d.PrivateNetworkCreate = opts.Bool(flagPrivateNetworkCreate)
+	d.PrivateNetworkSubnet = opts.String(flagPrivateNetworkSubnet)
+	d.PrivateNetworkGateway = opts.String(flagPrivateNetworkGateway)
+	d.PrivateNetworkDns = opts.StringSlice(flagPrivateNetworkDns)
+	d.CheckCredentials = opts.Bool(flagCheckCredentials)
+	d.FirewallAllow = opts.StringSlice(flagFirewallAllow)
+	d.Notes = opts.String(flagNotes)
+	d.ServerNameTemplate = opts.String(flagServerNameTemplate)
+	if opts.Bool(flagServerNameUseMachineName) {
+		d.ServerNameTemplate = "{{.MachineName}}"
+	}
+	d.OrphanedServer = opts.String(flagOrphanedServer)
+	d.CleanupOnFailure = opts.Bool(flagCleanupOnFailure)
+	d.ExistingServer = opts.String(flagExistingServer)
+	d.ExistingServerPassword = opts.String(flagExistingServerPassword)
+	d.ExistingServerSSHKey = opts.String(flagExistingServerSSHKey)
+	d.DryRun = opts.Bool(flagDryRun)
+	d.Backup = opts.Bool(flagBackup)
+	d.Managed = opts.Bool(flagManaged)
+	d.APICAFile = opts.String(flagAPICAFile)
+	d.APITimeout = opts.Int(flagAPITimeout)
+	d.APIDialTimeout = opts.Int(flagAPIDialTimeout)
+	d.APITLSHandshakeTimeout = opts.Int(flagAPITLSHandshakeTimeout)
+	d.APIRateLimit = opts.Int(flagAPIRateLimit)
+	d.APIRateLimitBurst = opts.Int(flagAPIRateLimitBurst)
+	d.APIRateLimitShared = opts.Bool(flagAPIRateLimitShared)
+	d.SSHPort = opts.Int(flagSSHPort)
+	d.SSHBootstrapTimeout = opts.Int(flagSSHBootstrapTimeout)
+	d.SSHDialTimeout = opts.Int(flagSSHDialTimeout)
+	if ! d.CleanupOnFailure && os.Getenv("CI") != "" && os.Getenv("CI") != "false" && os.Getenv("KAMATERA_CLEANUP_ON_FAILURE") == "" {
+		log.Debugf("CI environment detected, enabling --%s", flagCleanupOnFailure)
+		d.CleanupOnFailure = true
+	}
 
 	d.SetSwarmConfigFromFlags(opts)
 
@@ -208,53 +494,116 @@ func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 		return errors.Errorf("kamatera requires --%v to be set", flagAPISecret)
 	}
 
+	if d.APICAFile != "" {
+		if _, err := loadCAFile(d.APICAFile); err != nil {return err}
+	}
+
+	if err := ValidateImage(d.Image); err != nil {return err}
+
+	if d.PrivateNetworkIpRange != "" {
+		if _, err := ParseIPRange(d.PrivateNetworkIpRange); err != nil {return err}
+	}
+
+	if d.PrivateNetworkCreate {
+		if d.PrivateNetworkName == "" {
+			return errors.Errorf("kamatera requires --%v to be set when using --%v", flagPrivateNetworkName, flagPrivateNetworkCreate)
+		}
+		if err := ValidatePrivateNetworkCreate(d.PrivateNetworkSubnet, d.PrivateNetworkGateway, d.PrivateNetworkDns); err != nil {return err}
+	}
+
+	for _, rule := range d.FirewallAllow {
+		if _, err := ParseFirewallRule(rule); err != nil {return err}
+	}
+
+	d.requestedTraffic = d.Traffic
+	d.requestedPrivateNetworkIp = d.PrivateNetworkIp
+
+	tags, err := ParseTags(opts.StringSlice(flagTag))
+	if err != nil {return err}
+	d.Tags = tags
+
+	if _, err := template.New("server-name").Parse(d.ServerNameTemplate); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Invalid --%s", flagServerNameTemplate))
+	}
+
+	if d.ExistingServer != "" && d.ExistingServerPassword == "" && d.ExistingServerSSHKey == "" {
+		return errors.Errorf("kamatera requires --%v or --%v to be set when using --%v", flagExistingServerPassword, flagExistingServerSSHKey, flagExistingServer)
+	}
+
+	if ! IsStringInArray(d.OrphanedServer, []string{orphanedServerAdopt, orphanedServerTerminate, orphanedServerFail}) {
+		return errors.Errorf("Invalid --%v, must be one of: %s, %s, %s", flagOrphanedServer, orphanedServerAdopt, orphanedServerTerminate, orphanedServerFail)
+	}
+
 	return nil
 }
 
 type KamateraDiskImage struct {
-    Description string `json:description`
-    Id string `json:id`
-    SizeGB int `json:sizeGB`
+    Description string `json:"description"`
+    Id string `json:"id"`
+    SizeGB int `json:"sizeGB,omitempty"`
 }
 
 type KamateraNetwork struct {
-    Name string `json:name`
-    Ips interface{} `json:ips`
+    Name string `json:"name"`
+    Ips []string `json:"ips,omitempty"`
 }
 
 type KamateraTraffic struct {
-	Id interface{} `json:id`
-	Info string `json:info"`
+	Id interface{} `json:"id"`
+	Info string `json:"info"`
 }
 
 type KamateraServerOptions struct {
-    Datacenters map[string]string `json:datacenters`
-    Cpu []string `json:cpu`
+    Datacenters map[string]string `json:"datacenters"`
+    Cpu []string `json:"cpu"`
     // RAM structure changed to include a level of CPU type, which is the suffix letter of the selected CPU string
-    // Ram []int `json:ram`
-    Disk []int `json:disk`
-    Billing []string `json:billing`
-    DiskImages map[string][]KamateraDiskImage `json:datacenters`
-    Networks map[string][]KamateraNetwork `json:networks`
-    Traffic map[string][]KamateraTraffic `json:traffic`
+    // Ram []int `json:"ram"`
+    Disk []int `json:"disk"`
+    Billing []string `json:"billing"`
+    DiskImages map[string][]KamateraDiskImage `json:"diskImages"`
+    Networks map[string][]KamateraNetwork `json:"networks,omitempty"`
+    Traffic map[string][]KamateraTraffic `json:"traffic,omitempty"`
 }
 
 type KamateraServerCommandInfo struct {
-    Status string `json:status`
-    Server string `json:server`
-    Description string `json:description`
-    Log string `json:log`
+    Status string `json:"status"`
+    Server string `json:"server,omitempty"`
+    Description string `json:"description,omitempty"`
+    Log string `json:"log,omitempty"`
 }
 
 type KamateraPowerOperationInfo struct {
-    Status string `json:status`
+    Status string `json:"status"`
 }
 
 type KamateraServerListInfo struct {
-    Id string `json:id`
-    Datacenter string `json:datacenter`
-    Name string `json:name`
-    Power string `json:power`
+    Id string `json:"id"`
+    Datacenter string `json:"datacenter"`
+    Name string `json:"name"`
+    Power string `json:"power"`
+}
+
+type KamateraServerInfoNetwork struct {
+    Network string `json:"network"`
+    Ips []string `json:"ips"`
+}
+
+type KamateraServerInfo struct {
+    Id string `json:"id"`
+    Datacenter string `json:"datacenter"`
+    Name string `json:"name"`
+    Power string `json:"power"`
+    Networks []KamateraServerInfoNetwork `json:"networks"`
+}
+
+// GetPublicIp returns the first IP of the server's WAN network
+func (info *KamateraServerInfo) GetPublicIp() string {
+    for _, network := range info.Networks {
+        if strings.HasPrefix(network.Network, "wan") && len(network.Ips) > 0 {
+            return network.Ips[0]
+        }
+    }
+    return ""
 }
 
 func IsStringInArray(str string, arr []string) bool {
@@ -265,235 +614,630 @@ func IsIntInArray(i int, arr []int) bool {
     for _, n := range arr {if i == n {return true}}; return false
 }
 
+// ParseTags parses a list of key=value strings to a map of tags
+func ParseTags(tags []string) (map[string]string, error) {
+    res := map[string]string{}
+    for _, tag := range tags {
+        parts := strings.SplitN(tag, "=", 2)
+        if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+            return nil, errors.New(fmt.Sprintf("Invalid tag: %s (expected key=value)", tag))
+        }
+        res[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+    }
+    return res, nil
+}
+
+// GetTagsString returns the tags as a sorted, comma-separated list of key=value pairs
+func (d *Driver) GetTagsString() string {
+    var keys []string
+    for key := range d.Tags {keys = append(keys, key)}
+    sort.Strings(keys)
+    var tags []string
+    for _, key := range keys {tags = append(tags, fmt.Sprintf("%s=%s", key, d.Tags[key]))}
+    return strings.Join(tags, ",")
+}
+
+type KamateraServerNameTemplateData struct {
+    MachineName string
+    Datacenter string
+    Cpu string
+    Ram int
+    Random string
+}
+
+// GetServerName renders the server name template, the Random field is generated once per call
+func (d *Driver) GetServerName() (string, error) {
+    random, err := password.Generate(6, 0, 0, false, false)
+    if err != nil {return "", err}
+    tmpl, err := template.New("server-name").Parse(d.ServerNameTemplate)
+    if err != nil {return "", errors.Wrap(err, "Invalid server name template")}
+    var b bytes.Buffer
+    err = tmpl.Execute(&b, KamateraServerNameTemplateData{
+        MachineName: d.MachineName,
+        Datacenter: d.Datacenter,
+        Cpu: d.Cpu,
+        Ram: d.Ram,
+        Random: random,
+    })
+    if err != nil {return "", errors.Wrap(err, "Failed to render server name template")}
+    serverName := strings.TrimSpace(b.String())
+    if serverName == "" {return "", errors.New("Server name template rendered an empty server name")}
+    return serverName, nil
+}
+
+func IsAuthErrorStatusCode(statusCode int) bool {
+    return statusCode == 401 || statusCode == 403
+}
+
+func KamateraAuthError(statusCode int) error {
+    return errors.New(fmt.Sprintf("Kamatera API credentials rejected (status code %d), please check --%s / KAMATERA_API_CLIENT_ID and --%s / KAMATERA_API_SECRET", statusCode, flagAPIClientID, flagAPISecret))
+}
+
+func (d *Driver) checkKamateraCredentials() error {
+    log.Debugf("checkKamateraCredentials: %s", time.Now())
+    span := d.startAPISpan("check-credentials", 1)
+    resp, err := d.newRequest().
+        SetHeader("AuthClientId", d.APIClientID).
+        SetHeader("AuthSecret", d.APISecret).
+        Get("https://console.kamatera.com/service/server")
+    span.endResty(resp, err)
+    if err != nil {return errors.Wrap(err, "Failed to verify Kamatera API credentials")}
+    if IsAuthErrorStatusCode(resp.StatusCode()) {return KamateraAuthError(resp.StatusCode())}
+    if resp.StatusCode() != 200 {
+        log.Info(resp.String())
+        return errors.New(fmt.Sprintf("Failed to verify Kamatera API credentials, invalid status code: %d", resp.StatusCode()))
+    }
+    return nil
+}
+
 func (d *Driver) PreCreateCheck() error {
     log.Debugf("PreCreateCheck: %s", time.Now())
+    d.startEvents()
+    if d.CheckCredentials {
+        if err := d.checkKamateraCredentials(); err != nil {return err}
+        log.Infof("Kamatera API credentials are valid")
+        return errors.New(fmt.Sprintf("Kamatera API credentials verified, not creating a server (--%s)", flagCheckCredentials))
+    }
+    if err := d.validateServices(); err != nil {return err}
+    if d.ExistingServer != "" {
+        if err := d.resolveExistingServer(); err != nil {return err}
+        d.emitEvent(eventValidated, "existing server resolved")
+        return nil
+    }
     if d.CreateServerCommandId != 0 {
         log.Debugf("Skipping pre-create checks, continuing from existing command id = %d", d.CreateServerCommandId)
         return nil
     }
+    res, err := d.getServerOptions()
+    if err != nil {return err}
+    if err := d.validateDatacenter(res); err != nil {return err}
+    if d.DryRun {
+        return d.dryRun()
+    }
+    d.emitEvent(eventValidated, "create options validated")
+    return nil
+}
+
+// validateServices validates the backup and managed services options, which are set when the server is created
+func (d *Driver) validateServices() error {
+    if d.ExistingServer != "" && (d.Backup || d.Managed) {
+        return errors.New(fmt.Sprintf("--%s and --%s can't be used with --%s, please enable the services in the Kamatera console", flagBackup, flagManaged, flagExistingServer))
+    }
+    if d.CreateServerCommandId != 0 && (d.Backup || d.Managed) {
+        log.Warnf("Continuing from existing command id = %d, --%s and --%s are ignored", d.CreateServerCommandId, flagBackup, flagManaged)
+    }
+    return nil
+}
+
+// BoolToFormValue returns the 0 / 1 value used by Kamatera for boolean create options
+func BoolToFormValue(b bool) int {
+    if b {return 1}; return 0
+}
+
+func (d *Driver) getServerOptions() (*KamateraServerOptions, error) {
     i := 0
     for {
-        log.Debugf("PreCreateCheck (%d): %s", i, time.Now())
-        if i > 0 {time.Sleep(time.Duration(i * 6000) * time.Millisecond)}
+        log.Debugf("getServerOptions (%d): %s", i, time.Now())
+        if i > 0 {
+            if err := d.sleep(time.Duration(i * 6000) * time.Millisecond); err != nil {return nil, err}
+        }
         i += 1
-        resp, err := resty.R().
+        span := d.startAPISpan("get-server-options", i)
+        resp, err := d.newRequest().
             SetHeader("AuthClientId", d.APIClientID).
             SetHeader("AuthSecret", d.APISecret).
-            SetResult(KamateraServerOptions{}).
             Get("https://console.kamatera.com/service/server")
-        if err != nil {return err}
+        span.endResty(resp, err)
+        if err != nil {return nil, err}
         if resp.StatusCode() != 200 {
+            if IsAuthErrorStatusCode(resp.StatusCode()) {
+                return nil, KamateraAuthError(resp.StatusCode())
+            }
             if resp.StatusCode() == 404 {
-                return errors.New("Kamatera resource not found, please try again")
+                return nil, errors.New("Kamatera resource not found, please try again")
             }
             if resp.StatusCode() == 500 {
-                return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+                return nil, errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
             }
             log.Info(resp.String())
             if i >= 10 {
-                return errors.New(fmt.Sprintf("Invalid status code: %d", resp.StatusCode()))
+                return nil, errors.New(fmt.Sprintf("Invalid status code: %d", resp.StatusCode()))
             }
             log.Infof("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
             continue
         }
-        res := resp.Result().(*KamateraServerOptions)
-        d.DatacenterName = res.Datacenters[d.Datacenter]
-        if d.DatacenterName == "" {return errors.New("Invalid datacenter")}
-        if ! IsStringInArray(d.Cpu, res.Cpu) {return errors.New("Invalid CPU")}
-        // RAM server options contain an additional level of CPU type which is not handled in this validation
-        // if ! IsIntInArray(d.Ram, res.Ram) {return errors.New("Invalid ram")}
-        if d.Ram < 999 {return errors.New("Insufficient RAM, Please use at least 1GB of RAM.")}
-        if ! IsIntInArray(d.DiskSize, res.Disk) {return errors.New("Invalid disk size")}
-        if ! IsStringInArray(d.Billing, res.Billing) {return errors.New("Invalid billing")}
-        diskImages := res.DiskImages[d.Datacenter]
-        for _, diskImage := range diskImages {
-            if diskImage.Description == d.Image {
-                d.DiskImageId = diskImage.Id
-                break
-            }
-        }
-        if d.DiskImageId == "" {return errors.New(fmt.Sprintf("Invalid disk image: %s", d.Image))}
-        if d.PrivateNetworkName != "" {
-        	if d.PrivateNetworkIp == "" {
-                d.PrivateNetworkIp = "auto"
-            }
-        }
-        if d.Billing == "monthly" {
-            traffic_infos := "Available traffic options for monthly package:\n Traffic | Description\n"
-            first_traffic_id := ""
-            first_traffic_description := ""
-            for _, traffic := range res.Traffic[d.Datacenter] {
-                traffic_id := fmt.Sprintf("%v", traffic.Id)
-                if first_traffic_id == "" {
-                	first_traffic_id = traffic_id
-                	first_traffic_description = traffic.Info
+        return ParseServerOptions(resp.Body(), serverOptionsRequiredFields...)
+    }
+}
+
+// validateDatacenter validates the create options against the server options of the selected datacenter
+func (d *Driver) validateDatacenter(res *KamateraServerOptions) error {
+    d.DatacenterName = res.Datacenters[d.Datacenter]
+    if d.DatacenterName == "" {return errors.New(fmt.Sprintf("Invalid datacenter: %s", d.Datacenter))}
+    if ! IsStringInArray(d.Cpu, res.Cpu) {return errors.New("Invalid CPU")}
+    // RAM server options contain an additional level of CPU type which is not handled in this validation
+    // if ! IsIntInArray(d.Ram, res.Ram) {return errors.New("Invalid ram")}
+    if d.Ram < 999 {return errors.New("Insufficient RAM, Please use at least 1GB of RAM.")}
+    if ! IsIntInArray(d.DiskSize, res.Disk) {return errors.New("Invalid disk size")}
+    if ! IsStringInArray(d.Billing, res.Billing) {return errors.New("Invalid billing")}
+    if err := d.selectDiskImage(res.DiskImages[d.Datacenter]); err != nil {return err}
+    if d.PrivateNetworkName != "" {
+        if err := d.allocatePrivateNetworkIp(res.Networks[d.Datacenter]); err != nil {return err}
+    }
+    if d.Billing == "monthly" {
+        traffic_infos := "Available traffic options for monthly package:\n Traffic | Description\n"
+        first_traffic_id := ""
+        first_traffic_description := ""
+        for _, traffic := range res.Traffic[d.Datacenter] {
+            traffic_id, err := FormatTrafficId(traffic.Id)
+            if err != nil {return err}
+            if first_traffic_id == "" {
+            	first_traffic_id = traffic_id
+            	first_traffic_description = traffic.Info
 				}
 		        traffic_infos += fmt.Sprintf("%8s | %s\n", traffic_id, traffic.Info)
 		        if traffic_id == d.Traffic {
 		            d.TrafficDescription = traffic.Info
 		        }
 		    }
-            if d.TrafficDescription == "" {
-            	if d.Traffic == "" && first_traffic_id != "" {
-            		d.Traffic = first_traffic_id
-            		d.TrafficDescription = first_traffic_description
+        if d.TrafficDescription == "" {
+        	if d.Traffic == "" && first_traffic_id != "" {
+        		d.Traffic = first_traffic_id
+        		d.TrafficDescription = first_traffic_description
 				} else {
-					fmt.Println(traffic_infos)
+					log.Info(traffic_infos)
 					return errors.New(fmt.Sprintf("traffic flag is required when using monthly billing, please choose from the available traffic options"))
 				}
 		    }
 		}
-        return nil
-    }
+    return nil
 }
 
+// GetPrivateNetworkIp returns the private network IP, if not set a random IP is allocated from the available IPs
 func (d *Driver) GetPrivateNetworkIp() string {
 	if d.PrivateNetworkIp == "" {
-		rand.Seed(time.Now().Unix())
-		var newPrivateNetworkIps []string;
-		targetI := rand.Intn(len(d.PrivateNetworkIps))
-		targetIP := ""
-		for i, ip := range d.PrivateNetworkIps {
-			if i == targetI {
-				targetIP = ip
-			} else {
-				newPrivateNetworkIps = append(newPrivateNetworkIps, ip)
-			}
-		}
-		d.PrivateNetworkIps = newPrivateNetworkIps
-		log.Info("Using private network IP: ", targetIP)
-		return targetIP
-	} else {
-		return d.PrivateNetworkIp;
+		ip, remainingIps, err := AllocatePrivateNetworkIp(d.PrivateNetworkIps, rand.New(rand.NewSource(time.Now().UnixNano())))
+		if err != nil {return ""}
+		d.PrivateNetworkIps = remainingIps
+		d.PrivateNetworkIp = ip
+		log.Info("Using private network IP: ", ip)
 	}
+	return d.PrivateNetworkIp
 }
 
-func (d *Driver) Create() error {
+func (d *Driver) Create() (err error) {
     log.Debugf("Create: %s", time.Now())
+    defer func() {d.recordCreateDuration(err)}()
+    if d.ExistingServer != "" {
+        return d.createFromExistingServer()
+    }
+    created := false
     if d.CreateServerCommandId == 0 {
-        log.Infof("Creating Kamatera server...")
-        log.Infof("Datacenter: %s", d.DatacenterName)
-        log.Infof("Cpu: %s", d.Cpu)
-        log.Infof("Ram: %d", d.Ram)
-        log.Infof("Disk Size (GB): %d", d.DiskSize)
-        log.Infof("Disk Image: %s %s", d.Image, d.DiskImageId)
-        log.Infof("Billing: %s", d.Billing)
-        if d.Billing == "monthly" {
-        	log.Infof("Traffic package: %s", d.TrafficDescription)
+        adopted, err := d.checkPendingCreate()
+        if err != nil {return err}
+        if ! adopted {
+            if err := d.createServerInDatacenters(); err != nil {return err}
+            created = true
+        }
+    }
+    if ! created && d.IPAddress == "" {
+        if err := d.waitForCreateServerCommand(); err != nil {return d.cleanupOnFailure(err)}
+    }
+    if err := d.bootstrapServer(); err != nil {return d.cleanupOnFailure(err)}
+    d.removePendingCreate()
+    d.emitEvent(eventBootstrapped, "server is ready for provisioning")
+    return nil
+}
+
+// createServerInDatacenters creates the server and waits for the create command
+// on capacity errors the create is retried in the next datacenter of the --kamatera-datacenter list
+func (d *Driver) createServerInDatacenters() error {
+    for {
+        if err := d.createMissingPrivateNetwork(); err != nil {return err}
+        if err := d.createServer(); err != nil {
+            if isContextCancelled(d.getContext()) {return d.saveCancelledCreate(err)}
+            if ! IsCapacityError(err) {return err}
+            if err := d.useNextDatacenter(err); err != nil {return err}
+            continue
+        }
+        if d.IPAddress != "" {
+            // the server was adopted from a previous attempt of the create server request
+            return nil
+        }
+        if err := d.waitForCreateServerCommand(); err != nil {
+            if ! IsCapacityError(err) || len(d.getNextDatacenters()) == 0 {return d.cleanupOnFailure(err)}
+            if err := d.useNextDatacenter(err); err != nil {return d.cleanupOnFailure(err)}
+            continue
+        }
+        if len(d.Datacenters) > 1 {
+            log.Infof("Kamatera server %s created in datacenter %s", d.ServerName, d.Datacenter)
+        }
+        return nil
+    }
+}
+
+// dryRun prints the create server request and the estimated price, it always returns an error to stop the create
+func (d *Driver) dryRun() error {
+    serverName, err := d.GetServerName()
+    if err != nil {return err}
+    d.ServerName = serverName
+    privateNetworkIp := ""
+    if d.PrivateNetworkName != "" {privateNetworkIp = d.PrivateNetworkIp}
+    log.Infof("Datacenter: %s (%s)", d.Datacenter, d.DatacenterName)
+    log.Infof("Disk Image: %s %s", d.Image, d.DiskImageId)
+    log.Infof("Billing: %s", d.Billing)
+    if d.Billing == "monthly" {
+        log.Infof("Traffic package: %s %s", d.Traffic, d.TrafficDescription)
+    }
+    log.Infof("Daily backup: %t", d.Backup)
+    log.Infof("Managed services: %t", d.Managed)
+    log.Infof("Create server request:")
+    log.Infof("POST https://console.kamatera.com/service/server")
+    log.Infof("AuthClientId: %s", redacted)
+    log.Infof("AuthSecret: %s", redacted)
+    log.Infof("Content-Type: application/x-www-form-urlencoded")
+    log.Infof("%s", d.getCreateServerRequest(redacted, privateNetworkIp).Encode())
+    span := d.startAPISpan("get-server-price", 1)
+    resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
+        SetHeader("Content-Type", "application/x-www-form-urlencoded").
+        SetBody(d.getCreateServerRequest("", privateNetworkIp).Encode()).
+        Post("https://console.kamatera.com/service/server/price")
+    span.endResty(resp, err)
+    if err != nil {
+        log.Infof("Price estimation is not available: %s", err)
+    } else if resp.StatusCode() != 200 {
+        log.Infof("Price estimation is not available (status code %d)", resp.StatusCode())
+        log.Debug(resp.String())
+    } else {
+        var price map[string]interface{}
+        if err := json.Unmarshal(resp.Body(), &price); err != nil {
+            log.Infof("Estimated price: %s", resp.String())
+        } else {
+            var keys []string
+            for key := range price {keys = append(keys, key)}
+            sort.Strings(keys)
+            for _, key := range keys {
+                log.Infof("Estimated price (%s): %v", key, price[key])
+            }
+        }
+    }
+    return errors.New(fmt.Sprintf("Dry run completed, not creating a server (--%s)", flagDryRun))
+}
+
+// resolveExistingServer finds the existing server by name or ID
+func (d *Driver) resolveExistingServer() error {
+    servers, err := d.getKamateraServers()
+    if err != nil {return err}
+    for _, server := range servers {
+        if server.Name == d.ExistingServer || server.Id == d.ExistingServer {
+            d.ServerName = server.Name
+            d.KamateraServerId = server.Id
+            d.Datacenter = server.Datacenter
+            log.Infof("Using existing Kamatera server %s (server ID %s)", d.ServerName, d.KamateraServerId)
+            return nil
+        }
+    }
+    return errors.New(fmt.Sprintf("Existing Kamatera server not found: %s", d.ExistingServer))
+}
+
+func (d *Driver) createFromExistingServer() error {
+    if d.ServerName == "" {
+        if err := d.resolveExistingServer(); err != nil {return err}
+    }
+    info, err := d.getKamateraServerInfo(d.ServerName)
+    if err != nil {return err}
+    d.IPAddress = info.GetPublicIp()
+    if d.IPAddress == "" {
+        return errors.New(fmt.Sprintf("Failed to get the public IP of Kamatera server %s", d.ServerName))
+    }
+    log.Infof("Existing Kamatera server IP: %s", d.IPAddress)
+    d.Password = d.ExistingServerPassword
+    if err := d.bootstrapServer(); err != nil {
+        d.emitEvent(eventFailed, err.Error())
+        return err
+    }
+    d.emitEvent(eventBootstrapped, "server is ready for provisioning")
+    return nil
+}
+
+// getBootstrapAuthMethods returns the SSH authentication used to copy the machine SSH key to the server
+func (d *Driver) getBootstrapAuthMethods() ([]ssh.AuthMethod, error) {
+    var authMethods []ssh.AuthMethod
+    if d.ExistingServerSSHKey != "" {
+        buf, err := ioutil.ReadFile(d.ExistingServerSSHKey)
+        if err != nil {return nil, errors.Wrap(err, "could not read existing server ssh key")}
+        signer, err := ssh.ParsePrivateKey(buf)
+        if err != nil {return nil, errors.Wrap(err, "could not parse existing server ssh key")}
+        authMethods = append(authMethods, ssh.PublicKeys(signer))
+    }
+    if d.Password != "" {
+        authMethods = append(authMethods, ssh.Password(d.Password))
+    }
+    return authMethods, nil
+}
+
+// saveCancelledCreate persists the known server name and command ID so that the create can be resumed or cleaned up
+func (d *Driver) saveCancelledCreate(createErr error) error {
+    if d.ServerName == "" || d.ExistingServer != "" {return createErr}
+    if err := d.savePendingCreate(); err != nil {
+        log.Errorf("Failed to save the cancelled create, please check the Kamatera console for server %s: %s", d.ServerName, err)
+        return createErr
+    }
+    log.Infof("Create cancelled, saved server name %s and command ID %d to %s", d.ServerName, d.CreateServerCommandId, d.getPendingCreatePath())
+    log.Infof("Re-run create with the same machine name to resume or terminate the server (see --%s)", flagOrphanedServer)
+    return errors.Wrap(createErr, "Kamatera create cancelled")
+}
+
+// cleanupOnFailure terminates the server if --kamatera-cleanup-on-failure is set and returns the original error
+func (d *Driver) cleanupOnFailure(createErr error) error {
+    d.emitEvent(eventFailed, createErr.Error())
+    if isContextCancelled(d.getContext()) {return d.saveCancelledCreate(createErr)}
+    // existing servers are never terminated on failure
+    if ! d.CleanupOnFailure || d.ServerName == "" || d.ExistingServer != "" {return createErr}
+    log.Infof("Create failed, terminating Kamatera server %s: %s", d.ServerName, createErr)
+    if d.KamateraServerId == "" {
+        server, err := d.getKamateraServerByName(d.ServerName)
+        if err != nil {
+            log.Errorf("Failed to find the Kamatera server for cleanup, please terminate it manually: %s", err)
+            return createErr
+        }
+        if server == nil {
+            log.Infof("Kamatera server %s does not exist, nothing to cleanup", d.ServerName)
+            d.removePendingCreate()
+            return createErr
+        }
+        d.KamateraServerId = server.Id
+    }
+    commandId, err := d.terminateKamateraServer()
+    if err != nil {
+        log.Errorf("Failed to terminate the Kamatera server, please terminate it manually: %s", err)
+        return createErr
+    }
+    log.Infof("Waiting for Kamatera terminate server command to complete (command id = %d)", commandId)
+    if err := d.waitForKamateraCommand(commandId); err != nil {
+        log.Errorf("Failed to wait for the Kamatera server termination, please check the Kamatera console: %s", err)
+        return createErr
+    }
+    log.Infof("Kamatera server %s terminated", d.ServerName)
+    d.removePendingCreate()
+    return createErr
+}
+
+func (d *Driver) createServer() error {
+    log.Infof("Creating Kamatera server...")
+    log.Infof("Datacenter: %s", d.DatacenterName)
+    log.Infof("Cpu: %s", d.Cpu)
+    log.Infof("Ram: %d", d.Ram)
+    log.Infof("Disk Size (GB): %d", d.DiskSize)
+    log.Infof("Disk Image: %s %s", d.Image, d.DiskImageId)
+    log.Infof("Billing: %s", d.Billing)
+    if d.Billing == "monthly" {
+    	log.Infof("Traffic package: %s", d.TrafficDescription)
 		}
-        if d.PrivateNetworkName != "" {
-            log.Infof("Private network name: %s", d.PrivateNetworkName)
-            if d.PrivateNetworkIp != "" {
+    log.Infof("Daily backup: %t", d.Backup)
+    log.Infof("Managed services: %t", d.Managed)
+    if d.PrivateNetworkName != "" {
+        log.Infof("Private network name: %s", d.PrivateNetworkName)
+        if d.PrivateNetworkIp != "" {
 				log.Infof("Private network IP: %s", d.PrivateNetworkIp)
 			} else if len(d.PrivateNetworkIps) > 0 {
 				log.Info("Available private network IPs: ", len(d.PrivateNetworkIps))
-            } else {
-            	return errors.New("Invalid private network name or no available IPs")
-            }
+        } else {
+        	return errors.New("Invalid private network name or no available IPs")
         }
-        password_, err := password.Generate(12, 3, 0, false, false)
-        if err != nil {return err}
-        d.Password = password_
-        i := 0
-        for {
-			private_network_args := ""
-        	if d.PrivateNetworkName != "" {
-        		private_network_ip := d.GetPrivateNetworkIp()
-        		if private_network_ip == "" {
-        			return errors.New("Failed to get a private network IP")
+    }
+    if len(d.Tags) > 0 {
+        log.Infof("Tags: %s", d.GetTagsString())
+    }
+    if d.Notes != "" {
+        log.Infof("Notes: %s", d.Notes)
+    }
+    password_, err := password.Generate(12, 3, 0, false, false)
+    if err != nil {return err}
+    d.Password = password_
+    serverName, err := d.GetServerName()
+    if err != nil {return err}
+    d.ServerName = serverName
+    log.Infof("Server name: %s", d.ServerName)
+    // saved before the create server request, so that a server created by an interrupted request is found by the next create
+    // the pending create is saved again with the command ID once it is known
+    if err := d.savePendingCreate(); err != nil {return err}
+    // set after an attempt which may have created the server although it failed, such an attempt is not repeated
+    maybeCreated := false
+    i := 0
+    for {
+    	private_network_ip := ""
+    	if d.PrivateNetworkName != "" {
+    		private_network_ip = d.GetPrivateNetworkIp()
+    		if private_network_ip == "" {
+    			return errors.New("Failed to get a private network IP")
 				}
-				private_network_args = fmt.Sprintf("&network_name_1=%s&network_ip_1=%s", d.PrivateNetworkName, private_network_ip)
 			}
-			serverNameSuffix, err := password.Generate(6, 0, 0, false, false)
-			if err != nil {return err}
-			d.ServerName = fmt.Sprintf("%s-%s", d.MachineName, serverNameSuffix)
-			qs := fmt.Sprintf("datacenter=%s&name=%s&password=%s&cpu=%s&ram=%d&billing=%s&traffic=%s&disk_size_0=%d&disk_src_0=%s&network_name_0=%s&power=1&managed=0&backup=0%s", url.PathEscape(d.Datacenter), url.PathEscape(d.ServerName), url.PathEscape(d.Password), url.PathEscape(d.Cpu), d.Ram, url.PathEscape(d.Billing), url.PathEscape(d.Traffic), d.DiskSize, strings.Replace(url.PathEscape(d.DiskImageId), ":", "%3A", -1), "wan", private_network_args)
-			log.Debugf("https://console.kamatera.com/service/server?%s", qs)
+			qs := d.getCreateServerRequest(d.Password, private_network_ip).Encode()
+			log.Debugf("https://console.kamatera.com/service/server?%s", d.getCreateServerRequest(redacted, private_network_ip).Encode())
 			payload := strings.NewReader(qs)
 			log.Debugf("Create (%d): %s", i, time.Now())
-            if i > 0 {
-                log.Debugf("Retry %d / 10", i)
-                time.Sleep(time.Duration(i * 6000) * time.Millisecond)
+        if i > 0 {
+            log.Debugf("Retry %d / 10", i)
+            if err := d.sleep(time.Duration(i * 6000) * time.Millisecond); err != nil {return err}
+            if maybeCreated {
+                // the server is listed only once it is built, so a second request could create a duplicate server
+                server, err := d.waitForServerListed(d.ServerName, d.createRequestSent)
+                if err != nil {return err}
+                if server == nil {return d.serverNotListedError(d.ServerName, d.createRequestSent)}
+                return d.adoptRetriedServer(server)
             }
-            i += 1
-            req, err := http.NewRequest("POST", "https://console.kamatera.com/service/server", payload)
-            req.Header.Add("User-Agent", "docker-machine-driver-kamatera/v0.0.0")
-            req.Header.Add("Host", "console.kamatera.com")
-            req.Header.Add("Accept", "*/*")
-            req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-            req.Header.Add("AuthClientId", d.APIClientID)
-            req.Header.Add("AuthSecret", d.APISecret)
-            r, err := http.DefaultClient.Do(req)
-            if err != nil {
-                if i >= 10 {
-                    return errors.Wrap(err, "Unexpected error")
-                } else {
-                    log.Debugf("Unexpected error: %s", err)
-                    continue
-                }
+        }
+        i += 1
+        req, err := http.NewRequest("POST", "https://console.kamatera.com/service/server", payload)
+        if err != nil {return err}
+        req = req.WithContext(d.getContext())
+        req.Header.Add("User-Agent", UserAgent())
+        req.Header.Add("Host", "console.kamatera.com")
+        req.Header.Add("Accept", "*/*")
+        req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+        req.Header.Add("AuthClientId", d.APIClientID)
+        req.Header.Add("AuthSecret", d.APISecret)
+        if d.createRequestSent.IsZero() {
+            d.createRequestSent = time.Now()
+            if err := d.savePendingCreate(); err != nil {return err}
+        }
+        span := d.startAPISpan("create-server", i)
+        r, err := d.getHTTPClient().Do(req)
+        span.endHTTP(r, err)
+        if err != nil {
+            maybeCreated = maybeCreated || ! IsDialError(err)
+            if i >= 10 {
+                return errors.Wrap(err, "Unexpected error")
+            } else {
+                log.Debugf("Unexpected error: %s", err)
+                continue
             }
-            body, err := ioutil.ReadAll(r.Body)
-            if err != nil {
-                if i >= 10 {
-                    return errors.Wrap(err, "Failed to read Kamatera create server response body")
-                } else {
-                    log.Debugf("Failed to read Kamatera create server response body: %s", err)
-                    continue
-                }
+        }
+        // the body is read fully and closed on every attempt, so that the connection can be reused
+        body, err := ioutil.ReadAll(r.Body)
+        r.Body.Close()
+        if err != nil {
+            maybeCreated = true
+            if i >= 10 {
+                return errors.Wrap(err, "Failed to read Kamatera create server response body")
+            } else {
+                log.Debugf("Failed to read Kamatera create server response body: %s", err)
+                continue
             }
-            if r.StatusCode != 200 {
-                if r.StatusCode == 500 {
-                	if d.PrivateNetworkName == "" || d.PrivateNetworkIp != "" || i >= 10 {
+        }
+        if r.StatusCode != 200 {
+            if IsAuthErrorStatusCode(r.StatusCode) {
+                return KamateraAuthError(r.StatusCode)
+            }
+            if r.StatusCode == 500 {
+            	if IsCapacityErrorMessage(string(body)) {
+            		return &KamateraCapacityError{Datacenter: d.Datacenter, Message: string(body)}
+				}
+            	if d.PrivateNetworkName == "" || len(d.PrivateNetworkIps) == 0 || i >= 10 {
 						return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", string(body)))
 					} else {
-						log.Debugf(fmt.Sprintf("Kamatera API responded with an error, retrying: %s", string(body)))
+						// the allocated private network IP may have been taken by a server which is not in the local store
+						log.Infof("Kamatera API responded with an error, retrying with a different private network IP: %s", string(body))
+						d.PrivateNetworkIp = ""
 						continue
 					}
-                }
-                log.Info(string(body))
-                if i >= 10 {
-                    return errors.New(fmt.Sprintf("Invalid Kamatera create server response status: %d", r.StatusCode))
-                } else {
-                    log.Debugf("Got invalid status code: %d", r.StatusCode)
-                    continue
-                }
+            }
+            log.Info(string(body))
+            // a gateway error or timeout doesn't mean that Kamatera didn't handle the request
+            maybeCreated = maybeCreated || r.StatusCode >= 502
+            if i >= 10 {
+                return errors.New(fmt.Sprintf("Invalid Kamatera create server response status: %d", r.StatusCode))
             } else {
-                log.Debug(string(body))
+                log.Debugf("Got invalid status code: %d", r.StatusCode)
+                continue
             }
-            var CreateServerResponse []int
-            err = json.Unmarshal(body, &CreateServerResponse)
-            if err != nil {
-                if i >= 10 {
-                    return errors.Wrap(err, "Invalid JSON response from Kamatera create server")
-                } else {
-                    log.Debugf("Failed to parse Kamatera create server response body: %s", err)
-                    continue
-                }
+        } else {
+            log.Debug(string(body))
+        }
+        commandId, err := ParseCreateServerResponse(body)
+        if err == errNoCreateServerCommandId {
+            return errors.New(fmt.Sprintf("%s, please check the Kamatera console for server %s: %s", err, d.ServerName, string(body)))
+        } else if err != nil {
+            if i >= 10 {
+                return err
+            } else {
+                log.Debugf("Failed to parse Kamatera create server response body: %s", err)
+                maybeCreated = true
+                continue
             }
-            defer r.Body.Close()
-            d.CreateServerCommandId = CreateServerResponse[0]
-            break
         }
+        d.CreateServerCommandId = commandId
+        break
     }
+    d.emitEvent(eventCommandQueued, "create server command queued")
+    return d.savePendingCreate()
+}
+
+// adoptRetriedServer continues with a server which was created by a previous attempt of the create server request
+// the command ID of that attempt is unknown, so the server IP is taken from the server info
+func (d *Driver) adoptRetriedServer(server *KamateraServerListInfo) error {
+    log.Infof("Kamatera server %s was created by a previous attempt (server ID %s), continuing with this server", d.ServerName, server.Id)
+    d.KamateraServerId = server.Id
+    if err := d.savePendingCreate(); err != nil {return err}
+    for i := 1; ; i++ {
+        if err := d.sleep(5 * time.Second); err != nil {return err}
+        info, err := d.getKamateraServerInfo(d.ServerName)
+        if err != nil {
+            log.Debugf("Failed to get Kamatera server info: %s", err)
+        } else if ip := info.GetPublicIp(); ip != "" {
+            d.IPAddress = ip
+            log.Debugf("Server IP = '%s'", d.IPAddress)
+            return nil
+        }
+        if i >= 60 {
+            return d.cleanupOnFailure(errors.New(fmt.Sprintf("Failed to get the public IP of Kamatera server %s", d.ServerName)))
+        }
+    }
+}
+
+func (d *Driver) waitForCreateServerCommand() error {
     log.Infof("Waiting for Kamatera create server command to complete...")
     log.Infof("You can track progress in the Kamatera console web-ui (Command ID = %d)", d.CreateServerCommandId)
     createServerLog := ""
+    createServerStatus := ""
+    createServerLogLines := 0
     for {
         log.Debugf("Create/wait: %s", time.Now())
-        time.Sleep(2 * time.Second)
-        resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
-            SetHeader("AuthSecret", d.APISecret).SetResult(KamateraServerCommandInfo{}).
+        if err := d.sleep(2 * time.Second); err != nil {return err}
+        span := d.startAPISpan("get-create-server-command", 1)
+        resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).
+            SetHeader("AuthSecret", d.APISecret).
             Get(fmt.Sprintf("https://console.kamatera.com/service/queue/%d", d.CreateServerCommandId))
+        span.endResty(resp, err)
         if err != nil {return errors.Wrap(err, fmt.Sprintf("Failed to get Kamatera command info (%d)", d.CreateServerCommandId))}
         if resp.StatusCode() == 200 {
-            res := resp.Result().(*KamateraServerCommandInfo)
+            res, err := ParseCommandInfo("create server command", resp.Body())
+            if err != nil {return err}
             log.Debugf("%s", res.Status)
-            log.Debugf("%s", res.Log)
+            if res.Status != createServerStatus {
+                d.emitEventf(eventCommandProgress, "command status: %s", res.Status)
+                createServerStatus = res.Status
+            }
             createServerLog = res.Log
+            d.saveCreateServerLog(createServerLog)
+            var newLines []string
+            newLines, createServerLogLines = GetNewCommandLogLines(createServerLog, createServerLogLines, res.Status == "complete" || res.Status == "error" || res.Status == "cancelled")
+            for _, line := range newLines {
+                log.Infof("[%s] %s", time.Now().Format("15:04:05"), line)
+            }
             if res.Status == "complete" {break}
-            if res.Status == "error" {return errors.New("Kamatera create server failed")}
+            if res.Status == "error" {
+                if IsCapacityErrorMessage(createServerLog) {
+                    return &KamateraCapacityError{Datacenter: d.Datacenter, Message: "create server command failed"}
+                }
+                return errors.New("Kamatera create server failed")
+            }
             if res.Status == "cancelled" {return errors.New("Kamatera create server cancelled")}
 		} else {
+		    if IsAuthErrorStatusCode(resp.StatusCode()) {
+		        return KamateraAuthError(resp.StatusCode())
+		    }
 		    if resp.StatusCode() == 404 {
 		        log.Infof("Waiting for command to start...")
 		        continue
@@ -506,9 +1250,54 @@ func (d *Driver) Create() error {
         }
 	}
 	log.Infof("Kamatera create server command completed successfully (%s)", time.Now())
-	var pattern = regexp.MustCompile(` ([0-9]+.[0-9]+.[0-9]+.[0-9]+) `)
-	d.IPAddress = strings.Trim(pattern.FindString(createServerLog), " ")
+	// the server info has the IP of the WAN network, the command log may also contain gateway, DNS and private network IPs
+	info, err := d.getKamateraServerInfo(d.ServerName)
+	if err != nil {
+		log.Debugf("Failed to get the Kamatera server info: %s", err)
+	} else {
+		d.IPAddress = info.GetPublicIp()
+	}
+	if d.IPAddress == "" {
+		ip, err := ParseCreateServerIp(createServerLog)
+		if err != nil {return errors.New(fmt.Sprintf("Failed to find the IP of Kamatera server %s", d.ServerName))}
+		log.Warnf("Failed to get the IP of Kamatera server %s from the server info, using IP %s from the create server command log", d.ServerName, ip)
+		d.IPAddress = ip
+	}
 	log.Debugf("Server IP = '%s'", d.IPAddress)
+    return nil
+}
+
+// GetNewCommandLogLines returns the command log lines after the given number of already printed lines
+// the last line is returned only if it is complete (or if the command finished), so that partial lines are not printed
+func GetNewCommandLogLines(commandLog string, printedLines int, finished bool) ([]string, int) {
+    lines := strings.Split(strings.Replace(commandLog, "\r\n", "\n", -1), "\n")
+    if ! finished || lines[len(lines) - 1] == "" {
+        lines = lines[:len(lines) - 1]
+    }
+    if printedLines > len(lines) || printedLines < 0 {
+        // the log was truncated or replaced, print it from the start
+        printedLines = 0
+    }
+    var newLines []string
+    for _, line := range lines[printedLines:] {
+        if strings.TrimSpace(line) != "" {newLines = append(newLines, line)}
+    }
+    return newLines, len(lines)
+}
+
+// saveCreateServerLog saves the full create server command log in the machine directory
+func (d *Driver) saveCreateServerLog(commandLog string) {
+    path := d.ResolveStorePath("kamatera-create-server.log")
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        log.Debugf("Failed to create directory for the create server log: %s", err)
+        return
+    }
+    if err := ioutil.WriteFile(path, []byte(commandLog), 0600); err != nil {
+        log.Debugf("Failed to save the create server log: %s", err)
+    }
+}
+
+func (d *Driver) bootstrapServer() error {
 	log.Debugf("Generating SSH key...")
     if err := mcnssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
         return errors.Wrap(err, "could not generate ssh key")
@@ -518,42 +1307,19 @@ func (d *Driver) Create() error {
         return errors.Wrap(err, "could not read ssh public key")
     }
     pkey := string(buf)
+    deadline := time.Now().Add(getTimeoutDuration(d.SSHBootstrapTimeout, defaultSSHBootstrapTimeout))
     log.Debugf("Waiting for server status...")
     for {
         log.Debugf("Create/wait-status: %s", time.Now())
-        time.Sleep(2 * time.Second)
+        if err := d.sleep(2 * time.Second); err != nil {return err}
         srvstate, _ := d.GetState()
-        if srvstate == state.Running {break}
-    }
-    config := &ssh.ClientConfig{
-        User: "root",
-        Auth: []ssh.AuthMethod{
-            ssh.Password(d.Password),
-        },
-        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-    }
-    log.Debugf("Copying SSH key to the server and performing initialization")
-    for {
-        log.Debugf("Create/ssh: %s", time.Now())
-        time.Sleep(2 * time.Second)
-        client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", d.IPAddress), config)
-        if err == nil {
-            session, err := client.NewSession()
-            if err == nil {
-                defer session.Close()
-                var b bytes.Buffer
-                session.Stdout = &b
-                cmd := fmt.Sprintf("bash -c 'mkdir -p .ssh && echo \"%s\" >> .ssh/authorized_keys'", pkey)
-                log.Debugf("Running ssh cmd: %s", cmd)
-                err = session.Run(cmd)
-                if err != nil {return errors.Wrap(err, "Failed to copy SSH key to the Kamatera server")}
-                log.Debugf("SSH Initialization completed successfully (%s)", time.Now())
-                return nil
-            }
-        } else {
-            log.Debugf("SSH failure (%s): %s", time.Now(), err)
+        if srvstate == state.Running {
+            d.emitEvent(eventRunning, "server is running")
+            break
         }
+        if time.Now().After(deadline) {return errors.New("Timed out waiting for the Kamatera server to be running")}
     }
+    return d.copySSHKey(pkey, deadline)
 }
 
 func (d *Driver) GetSSHHostname() (string, error) {
@@ -586,12 +1352,19 @@ func (d *Driver) getKamateraServerPower() (string, error) {
     i := 0
     for {
         log.Debugf("getKamateraServerPower: %s", time.Now())
-        if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
+        if i > 0 {
+            if err := d.sleep(2000 + time.Duration(i * 3000) * time.Millisecond); err != nil {return "", err}
+        }
         i += 1
-        resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
+        span := d.startAPISpan("get-server-power", i)
+        resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).
             SetHeader("AuthSecret", d.APISecret).Get("https://console.kamatera.com/service/servers")
+        span.endResty(resp, err)
         if err != nil {return "", errors.Wrap(err, "Failed to get Kamatera server power")}
         if resp.StatusCode() != 200 {
+            if IsAuthErrorStatusCode(resp.StatusCode()) {
+                return "", KamateraAuthError(resp.StatusCode())
+            }
             if resp.StatusCode() == 404 {
                 return "", errors.New("Kamatera resource not found")
             }
@@ -607,8 +1380,8 @@ func (d *Driver) getKamateraServerPower() (string, error) {
             }
         }
 	log.Debug(resp.String())
-        var servers []KamateraServerListInfo
-        json.Unmarshal(resp.Body(), &servers)
+        servers, err := ParseServerList(resp.Body(), "[].name", "[].power")
+        if err != nil {return "", err}
         serverPower := ""
         for _, server := range servers {
             if server.Name == d.ServerName {
@@ -620,84 +1393,188 @@ func (d *Driver) getKamateraServerPower() (string, error) {
     }
 }
 
-func (d *Driver) getKamateraServerId() (string, error) {
-    if d.KamateraServerId == "" {
-        i := 0
-        for {
-            log.Debugf("Getting kamatera server id (%s): %d", time.Now(), i)
-            if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
-            i += 1
-            resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
-                SetHeader("AuthSecret", d.APISecret).Get("https://console.kamatera.com/service/servers")
-            if err != nil {return "", errors.Wrap(err, "Failed to get Kamatera servers list")}
-            if resp.StatusCode() != 200 {
-                if resp.StatusCode() == 404 {
-                    return "", errors.New("Kamatera resource not found")
-                }
-                if resp.StatusCode() == 500 {
-                    return "", errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
-                }
-                log.Info(resp.String())
-                if i >= 10 {
-                    return "", errors.New(fmt.Sprintf("Invalid Kamatera servers status: %d", resp.StatusCode()))
-                } else {
-                    log.Debugf("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
-                    continue
-                }
+func (d *Driver) getKamateraServers() ([]KamateraServerListInfo, error) {
+    i := 0
+    for {
+        log.Debugf("Getting kamatera servers (%s): %d", time.Now(), i)
+        if i > 0 {
+            if err := d.sleep(2000 + time.Duration(i * 3000) * time.Millisecond); err != nil {return nil, err}
+        }
+        i += 1
+        span := d.startAPISpan("list-servers", i)
+        resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).
+            SetHeader("AuthSecret", d.APISecret).Get("https://console.kamatera.com/service/servers")
+        span.endResty(resp, err)
+        if err != nil {return nil, errors.Wrap(err, "Failed to get Kamatera servers list")}
+        if resp.StatusCode() != 200 {
+            if IsAuthErrorStatusCode(resp.StatusCode()) {
+                return nil, KamateraAuthError(resp.StatusCode())
             }
-            var servers []KamateraServerListInfo
-            json.Unmarshal(resp.Body(), &servers)
-            serverId := ""
-            for _, server := range servers {
-                if server.Name == d.ServerName {
-                    serverId = server.Id
-                    break
-                }
+            if resp.StatusCode() == 404 {
+                return nil, errors.New("Kamatera resource not found")
             }
-            if serverId == "" {
-                return "", errors.Wrap(err, "Failed to find Kamatera server ID")
+            if resp.StatusCode() == 500 {
+                return nil, errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+            }
+            log.Info(resp.String())
+            if i >= 10 {
+                return nil, errors.New(fmt.Sprintf("Invalid Kamatera servers status: %d", resp.StatusCode()))
             } else {
-                d.KamateraServerId = serverId
+                log.Debugf("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
+                continue
+            }
+        }
+        return ParseServerList(resp.Body(), "[].id", "[].name")
+    }
+}
+
+// getKamateraServerByName returns nil if a server with the given name was not found
+func (d *Driver) getKamateraServerByName(name string) (*KamateraServerListInfo, error) {
+    servers, err := d.getKamateraServers()
+    if err != nil {return nil, err}
+    for _, server := range servers {
+        if server.Name == name {
+            return &server, nil
+        }
+    }
+    return nil, nil
+}
+
+func (d *Driver) getKamateraServerInfo(name string) (*KamateraServerInfo, error) {
+    i := 0
+    for {
+        log.Debugf("Getting kamatera server info (%s): %d", time.Now(), i)
+        if i > 0 {
+            if err := d.sleep(2000 + time.Duration(i * 3000) * time.Millisecond); err != nil {return nil, err}
+        }
+        i += 1
+        span := d.startAPISpan("get-server-info", i)
+        resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
+            SetFormData(map[string]string{"name":name}).
+            Post("https://console.kamatera.com/service/server/info")
+        span.endResty(resp, err)
+        if err != nil {return nil, errors.Wrap(err, "Failed to get Kamatera server info")}
+        if resp.StatusCode() != 200 {
+            if IsAuthErrorStatusCode(resp.StatusCode()) {
+                return nil, KamateraAuthError(resp.StatusCode())
+            }
+            if resp.StatusCode() == 404 {
+                return nil, errors.New("Kamatera resource not found")
+            }
+            if resp.StatusCode() == 500 {
+                return nil, errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+            }
+            log.Info(resp.String())
+            if i >= 10 {
+                return nil, errors.New(fmt.Sprintf("Invalid Kamatera server info status: %d", resp.StatusCode()))
+            } else {
+                log.Debugf("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
+                continue
             }
-            break
         }
+        var servers []KamateraServerInfo
+        if err := DecodeKamateraResponse("server info", resp.Body(), &servers, "[].name", "[].networks"); err != nil {return nil, err}
+        for _, server := range servers {
+            if server.Name == name {return &server, nil}
+        }
+        return nil, errors.New(fmt.Sprintf("Kamatera server not found: %s", name))
+    }
+}
+
+func (d *Driver) getKamateraServerId() (string, error) {
+    if d.KamateraServerId == "" {
+        server, err := d.getKamateraServerByName(d.ServerName)
+        if err != nil {return "", err}
+        if server == nil {
+            return "", errors.New("Failed to find Kamatera server ID")
+        }
+        d.KamateraServerId = server.Id
     }
     return d.KamateraServerId, nil
 }
 
 func (d *Driver) Remove() error {
-    serverId, err := d.getKamateraServerId()
+    removeServerCommandId, err := d.terminateKamateraServer()
     if err != nil {return err}
+    log.Infof("Kamatera remove server started, track progress in Kamatera console, command id = %d", removeServerCommandId)
+    d.removePendingCreate()
+    return nil
+}
+
+func (d *Driver) terminateKamateraServer() (int, error) {
+    serverId, err := d.getKamateraServerId()
+    if err != nil {return 0, err}
     log.Debugf("Removing Kamatera server ID %s", serverId)
     i := 0
     for {
         log.Debugf("Removing server (%s): %d", time.Now(), i)
-        if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
+        if i > 0 {
+            if err := d.sleep(2000 + time.Duration(i * 3000) * time.Millisecond); err != nil {return 0, err}
+        }
         i += 1
-        resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
+        span := d.startAPISpan("terminate-server", i)
+        resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
             SetFormData(map[string]string{"confirm":"1","force":"1"}).
             Delete(fmt.Sprintf("https://console.kamatera.com/service/server/%s/terminate", serverId))
-        if err != nil {return errors.Wrap(err, "Failed to run terminate operation")}
+        span.endResty(resp, err)
+        if err != nil {return 0, errors.Wrap(err, "Failed to run terminate operation")}
         if resp.StatusCode() != 200 {
+            if IsAuthErrorStatusCode(resp.StatusCode()) {
+                return 0, KamateraAuthError(resp.StatusCode())
+            }
             if resp.StatusCode() == 404 {
-                return errors.New("Kamatera resource not found")
+                return 0, errors.New("Kamatera resource not found")
             }
             if resp.StatusCode() == 500 {
-                return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+                return 0, errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
             }
             log.Info(resp.String())
             if i >= 10 {
-                return errors.New(fmt.Sprintf("Invalid Kamatera remove server status: %d", resp.StatusCode()))
+                return 0, errors.New(fmt.Sprintf("Invalid Kamatera remove server status: %d", resp.StatusCode()))
             } else {
                 log.Infof("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
                 continue
             }
         }
         var removeServerCommandId int
-        err = json.Unmarshal(resp.Body(), &removeServerCommandId)
-        if err != nil {return errors.Wrap(err, "Invalid JSON response from Kamatera remove server")}
-        log.Infof("Kamatera remove server started, track progress in Kamatera console, command id = %d", removeServerCommandId)
-        return nil
+        err = DecodeKamateraResponse("remove server", resp.Body(), &removeServerCommandId)
+        if err != nil {return 0, err}
+        return removeServerCommandId, nil
+    }
+}
+
+func (d *Driver) waitForKamateraCommand(commandId int) error {
+    i := 0
+    for {
+        log.Debugf("Waiting for command %d (%s)", commandId, time.Now())
+        if err := d.sleep(2000 * time.Millisecond); err != nil {return err}
+        span := d.startAPISpan("get-command", i + 1)
+        resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).
+            SetHeader("AuthSecret", d.APISecret).
+            Get(fmt.Sprintf("https://console.kamatera.com/service/queue/%d", commandId))
+        span.endResty(resp, err)
+        if err != nil {return errors.Wrap(err, fmt.Sprintf("Failed to get Kamatera command info (%d)", commandId))}
+        if resp.StatusCode() != 200 {
+            if IsAuthErrorStatusCode(resp.StatusCode()) {
+                return KamateraAuthError(resp.StatusCode())
+            }
+            if resp.StatusCode() == 500 {
+                return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+            }
+            i += 1
+            log.Info(resp.String())
+            if i >= 10 {
+                return errors.New(fmt.Sprintf("Invalid Kamatera command wait status: %d", resp.StatusCode()))
+            }
+            log.Infof("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
+            continue
+        }
+        var res KamateraPowerOperationInfo
+        if err := DecodeKamateraResponse("command", resp.Body(), &res, "status"); err != nil {return err}
+        log.Debugf("%s", res.Status)
+        if res.Status == "complete" {return nil}
+        if res.Status == "error" {return errors.New(fmt.Sprintf("Kamatera command failed (%d)", commandId))}
+        if res.Status == "cancelled" {return errors.New(fmt.Sprintf("Kamatera command cancelled (%d)", commandId))}
     }
 }
 
@@ -708,13 +1585,20 @@ func (d *Driver) kamateraPower(power string) error {
     i := 0
     for {
         log.Debugf("Running power operation (%s): %d", time.Now(), i)
-        if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
+        if i > 0 {
+            if err := d.sleep(2000 + time.Duration(i * 3000) * time.Millisecond); err != nil {return err}
+        }
         i += 1
-        resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
+        span := d.startAPISpan("power-server", i)
+        resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
             SetFormData(map[string]string{"power":power}).
             Put(fmt.Sprintf("https://console.kamatera.com/service/server/%s/power", serverId))
+        span.endResty(resp, err)
         if err != nil {return errors.Wrap(err, "Failed to run power operation")}
         if resp.StatusCode() != 200 {
+            if IsAuthErrorStatusCode(resp.StatusCode()) {
+                return KamateraAuthError(resp.StatusCode())
+            }
             if resp.StatusCode() == 404 {
                 return errors.New("Kamatera resource not found")
             }
@@ -729,18 +1613,23 @@ func (d *Driver) kamateraPower(power string) error {
             continue
         }
         var powerOperationCommandId int
-        err = json.Unmarshal(resp.Body(), &powerOperationCommandId)
-        if err != nil {return errors.Wrap(err, "Invalid JSON response from Kamatera power operation")}
+        err = DecodeKamateraResponse("power operation", resp.Body(), &powerOperationCommandId)
+        if err != nil {return err}
         log.Info("Waiting for Kamatera power operation to complete")
         log.Infof("track progress in Kamatera console, command id = %d", powerOperationCommandId)
         for {
             log.Debugf("Waiting for power operation (%s)", time.Now())
-            time.Sleep(2000 * time.Millisecond)
-            resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
-                SetHeader("AuthSecret", d.APISecret).SetResult(KamateraPowerOperationInfo{}).
+            if err := d.sleep(2000 * time.Millisecond); err != nil {return err}
+            waitSpan := d.startAPISpan("get-power-command", 1)
+            resp, err := d.newRequest().SetHeader("AuthClientId", d.APIClientID).
+                SetHeader("AuthSecret", d.APISecret).
                 Get(fmt.Sprintf("https://console.kamatera.com/service/queue/%d", powerOperationCommandId))
+            waitSpan.endResty(resp, err)
             if err != nil {return errors.Wrap(err, fmt.Sprintf("Failed to get Kamatera command info (%d)", powerOperationCommandId))}
             if resp.StatusCode() != 200 {
+                if IsAuthErrorStatusCode(resp.StatusCode()) {
+                    return KamateraAuthError(resp.StatusCode())
+                }
                 if resp.StatusCode() == 500 {
                     return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
                 }
@@ -756,7 +1645,8 @@ func (d *Driver) kamateraPower(power string) error {
                     }
                 }
             }
-            res := resp.Result().(*KamateraPowerOperationInfo)
+            var res KamateraPowerOperationInfo
+            if err := DecodeKamateraResponse("power operation command", resp.Body(), &res, "status"); err != nil {return err}
             log.Debugf("%s", res.Status)
             if res.Status == "complete" {
 	            log.Infof("Kamatera power operation completed successfully")
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// create progress events, emitted as JSON lines when KAMATERA_LOG_FORMAT=json or KAMATERA_EVENTS_FILE is set
+const (
+	eventValidated       = "validated"
+	eventCommandQueued   = "command-queued"
+	eventCommandProgress = "command-progress"
+	eventRunning         = "running"
+	eventSSHReady        = "ssh-ready"
+	eventBootstrapped    = "bootstrapped"
+	eventFailed          = "failed"
+)
+
+type KamateraEvent struct {
+	Time           string  `json:"time"`
+	Event          string  `json:"event"`
+	MachineName    string  `json:"machine_name"`
+	ServerName     string  `json:"server_name,omitempty"`
+	CommandId      int     `json:"command_id,omitempty"`
+	ServerId       string  `json:"server_id,omitempty"`
+	IPAddress      string  `json:"ip,omitempty"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Message        string  `json:"message,omitempty"`
+}
+
+func IsJSONLogFormat() bool {
+	return os.Getenv("KAMATERA_LOG_FORMAT") == "json"
+}
+
+// getEventsFile returns the file which events are appended to, docker-machine prefixes the plugin output with the
+// machine name, so the file is easier to parse than the output
+func getEventsFile() string {
+	return os.Getenv("KAMATERA_EVENTS_FILE")
+}
+
+// appendEvent appends an event line to the events file, each line is a single write so that parallel creates don't mix lines
+func appendEvent(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// startEvents sets the start time which is used to calculate the elapsed time of events
+func (d *Driver) startEvents() {
+	if d.eventsStartedAt.IsZero() {
+		d.eventsStartedAt = time.Now()
+	}
+}
+
+func (d *Driver) emitEvent(event string, message string) {
+	d.startEvents()
+	eventsFile := getEventsFile()
+	if !IsJSONLogFormat() && eventsFile == "" {
+		log.Debugf("Event %s: %s", event, message)
+		return
+	}
+	buf, err := json.Marshal(KamateraEvent{
+		Time:           time.Now().UTC().Format(time.RFC3339),
+		Event:          event,
+		MachineName:    d.MachineName,
+		ServerName:     d.ServerName,
+		CommandId:      d.CreateServerCommandId,
+		ServerId:       d.KamateraServerId,
+		IPAddress:      d.IPAddress,
+		ElapsedSeconds: time.Since(d.eventsStartedAt).Seconds(),
+		Message:        message,
+	})
+	if err != nil {
+		log.Debugf("Failed to encode event %s: %s", event, err)
+		return
+	}
+	if eventsFile != "" {
+		if err := appendEvent(eventsFile, buf); err != nil {
+			log.Warnf("Failed to write event to %s: %s", eventsFile, err)
+		}
+	}
+	if IsJSONLogFormat() {
+		log.Info(string(buf))
+	}
+}
+
+func (d *Driver) emitEventf(event string, format string, args ...interface{}) {
+	d.emitEvent(event, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEventsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kamatera-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+	os.Setenv("KAMATERA_EVENTS_FILE", path)
+	defer os.Unsetenv("KAMATERA_EVENTS_FILE")
+	d := NewDriver()
+	d.MachineName = "my-machine"
+	d.emitEvent(eventValidated, "create options validated")
+	d.CreateServerCommandId = 123
+	d.emitEventf(eventCommandQueued, "command %d queued", 123)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	var event KamateraEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != eventCommandQueued || event.MachineName != "my-machine" || event.CommandId != 123 || event.Message != "command 123 queued" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHScript scripts the behavior of a fakeSSHServer
+type fakeSSHScript struct {
+	// Password which the server accepts
+	Password string
+	// RefuseConnections closes the first N connections before the SSH handshake
+	RefuseConnections int
+	// RejectPassword rejects the password even if it matches
+	RejectPassword bool
+	// ExitStatus is returned for all commands, non-zero fails the command
+	ExitStatus uint32
+}
+
+// fakeSSHServer is an in-process SSH server for testing the bootstrap, it can be scripted to fail in different ways
+type fakeSSHServer struct {
+	script   fakeSSHScript
+	listener net.Listener
+	mu       sync.Mutex
+	conns    int
+	commands []string
+	wg       sync.WaitGroup
+}
+
+// newFakeSSHServer starts the server on a random local port, it is closed when the test ends
+func newFakeSSHServer(t *testing.T, script fakeSSHScript) *fakeSSHServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSSHServer{script: script, listener: listener}
+	// RSA, the x/crypto version in Gopkg.lock doesn't support crypto/ed25519 keys
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.script.RejectPassword || string(password) != s.script.Password {
+				return nil, errors.New("password rejected")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	s.wg.Add(1)
+	go s.serve(config)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Host and Port return the address to set as the driver SSH target
+func (s *fakeSSHServer) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *fakeSSHServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSSHServer) Addr() string {
+	return net.JoinHostPort(s.Host(), strconv.Itoa(s.Port()))
+}
+
+// Connections returns the number of accepted TCP connections, including refused ones
+func (s *fakeSSHServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// Commands returns the commands which were executed, in order
+func (s *fakeSSHServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *fakeSSHServer) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *fakeSSHServer) serve(config *ssh.ServerConfig) {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		refuse := s.conns <= s.script.RefuseConnections
+		s.mu.Unlock()
+		if refuse {
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go s.handleConn(conn, config)
+	}
+}
+
+func (s *fakeSSHServer) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer s.wg.Done()
+	defer conn.Close()
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		s.handleSession(channel, requests)
+	}
+}
+
+// handleSession records the exec command and replies with the scripted exit status
+func (s *fakeSSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		s.mu.Lock()
+		s.commands = append(s.commands, payload.Command)
+		s.mu.Unlock()
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, s.script.ExitStatus)
+		channel.SendRequest("exit-status", false, status)
+		return
+	}
+}
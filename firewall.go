@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// dockerPort is the port docker-machine uses to connect to the docker daemon
+const dockerPort = 2376
+
+// swarmMasterPort is the port used by the swarm manager when running as swarm master
+const swarmMasterPort = 3376
+
+type FirewallRule struct {
+	Protocol string
+	Port     string
+	Source   string
+}
+
+// ParseFirewallRule parses a firewall rule in the format protocol:port[:source]
+// port can be a single port or a range (e.g. 8000-8100), source is an optional IPv4 or IPv6 address or CIDR
+func ParseFirewallRule(rule string) (FirewallRule, error) {
+	// an IPv6 source contains colons, so everything after the port is the source
+	parts := strings.SplitN(rule, ":", 3)
+	if len(parts) < 2 {
+		return FirewallRule{}, errors.New(fmt.Sprintf("Invalid firewall rule: %s (expected protocol:port[:source])", rule))
+	}
+	res := FirewallRule{Protocol: strings.ToLower(parts[0]), Port: parts[1]}
+	if res.Protocol != "tcp" && res.Protocol != "udp" {
+		return FirewallRule{}, errors.New(fmt.Sprintf("Invalid firewall rule protocol: %s (must be tcp or udp)", parts[0]))
+	}
+	ports := strings.Split(res.Port, "-")
+	if len(ports) > 2 {
+		return FirewallRule{}, errors.New(fmt.Sprintf("Invalid firewall rule port: %s", res.Port))
+	}
+	var portNums []int
+	for _, port := range ports {
+		portNum, err := strconv.Atoi(port)
+		if err != nil || portNum < 1 || portNum > 65535 {
+			return FirewallRule{}, errors.New(fmt.Sprintf("Invalid firewall rule port: %s", res.Port))
+		}
+		portNums = append(portNums, portNum)
+	}
+	if len(portNums) == 2 && portNums[0] > portNums[1] {
+		return FirewallRule{}, errors.New(fmt.Sprintf("Invalid firewall rule port range: %s (the first port must not be greater than the last port)", res.Port))
+	}
+	if len(parts) == 3 && parts[2] != "" {
+		res.Source = parts[2]
+		if _, _, err := net.ParseCIDR(res.Source); err != nil && net.ParseIP(res.Source) == nil {
+			return FirewallRule{}, errors.New(fmt.Sprintf("Invalid firewall rule source: %s (must be an IP or CIDR)", res.Source))
+		}
+	}
+	return res, nil
+}
+
+func (r FirewallRule) String() string {
+	if r.Source == "" {
+		return fmt.Sprintf("%s:%s", r.Protocol, r.Port)
+	}
+	return fmt.Sprintf("%s:%s:%s", r.Protocol, r.Port, r.Source)
+}
+
+// IncludesPort returns true if the rule applies to the given protocol and port, the rule source is not checked
+func (r FirewallRule) IncludesPort(protocol string, port int) bool {
+	if r.Protocol != protocol {
+		return false
+	}
+	ports := strings.Split(r.Port, "-")
+	first, _ := strconv.Atoi(ports[0])
+	last := first
+	if len(ports) == 2 {
+		last, _ = strconv.Atoi(ports[1])
+	}
+	return port >= first && port <= last
+}
+
+// isIPv6 returns true if the rule source is an IPv6 address or CIDR
+func (r FirewallRule) isIPv6() bool {
+	ip := net.ParseIP(r.Source)
+	if ip == nil {
+		ip, _, _ = net.ParseCIDR(r.Source)
+	}
+	return ip != nil && ip.To4() == nil
+}
+
+func (r FirewallRule) iptablesArgs() string {
+	args := fmt.Sprintf("-p %s --dport %s", r.Protocol, strings.Replace(r.Port, "-", ":", 1))
+	if r.Source != "" {
+		args += fmt.Sprintf(" -s %s", r.Source)
+	}
+	return args
+}
+
+// forwardIptablesArgs matches the port which the connection was sent to, before docker translated it to the container port
+func (r FirewallRule) forwardIptablesArgs() string {
+	args := fmt.Sprintf("-p %s -m conntrack --ctorigdstport %s", r.Protocol, strings.Replace(r.Port, "-", ":", 1))
+	if r.Source != "" {
+		args += fmt.Sprintf(" -s %s", r.Source)
+	}
+	return args
+}
+
+// getFirewallRules returns the user firewall rules, followed by the rules which docker-machine requires
+// the ports which docker-machine requires are allowed from any source, unless the user gave a rule for them
+func (d *Driver) getFirewallRules() ([]FirewallRule, error) {
+	var rules []FirewallRule
+	for _, rule := range d.FirewallAllow {
+		parsedRule, err := ParseFirewallRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, parsedRule)
+	}
+	requiredPorts := []int{d.SSHPort, dockerPort}
+	if d.SwarmMaster {
+		requiredPorts = append(requiredPorts, swarmMasterPort)
+	}
+	for _, port := range requiredPorts {
+		allowed := false
+		for _, rule := range rules {
+			if rule.IncludesPort("tcp", port) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			rules = append(rules, FirewallRule{Protocol: "tcp", Port: strconv.Itoa(port)})
+		}
+	}
+	return rules, nil
+}
+
+// firewallScript returns a script which allows only the given rules for incoming IPv4 and IPv6 traffic
+// the rules apply to the host ports and to the ports published by docker containers
+// with a private network, all traffic is allowed on the interfaces other than the public interface (which has the default route)
+// the script is installed as a systemd service so that the rules are re-applied on reboot
+func firewallScript(rules []FirewallRule, allowPrivateNetwork bool) string {
+	script := "#!/bin/sh\n" +
+		"WAN_INTERFACE=$(ip route show default | awk '{print $5; exit}')\n"
+	script += firewallChainScript("iptables", "icmp", rules, false, allowPrivateNetwork)
+	script += "if command -v ip6tables >/dev/null; then\n" +
+		firewallChainScript("ip6tables", "ipv6-icmp", rules, true, allowPrivateNetwork) +
+		"fi\n"
+	return script
+}
+
+// firewallChainScript returns the commands which create the firewall chains of one IP version
+// KAMATERA-FIREWALL filters the traffic to the host, KAMATERA-FIREWALL-FORWARD filters the traffic from the public interface to the docker published ports
+// docker sends the forwarded traffic through DOCKER-USER and doesn't flush it, the chain is created here if docker didn't start yet
+// rules with a source of the other IP version are skipped
+func firewallChainScript(iptables string, icmp string, rules []FirewallRule, ipv6 bool, allowPrivateNetwork bool) string {
+	script := fmt.Sprintf("%s -F KAMATERA-FIREWALL 2>/dev/null || %s -N KAMATERA-FIREWALL\n", iptables, iptables) +
+		fmt.Sprintf("%s -C INPUT -j KAMATERA-FIREWALL 2>/dev/null || %s -I INPUT -j KAMATERA-FIREWALL\n", iptables, iptables) +
+		fmt.Sprintf("%s -A KAMATERA-FIREWALL -i lo -j RETURN\n", iptables)
+	if allowPrivateNetwork {
+		script += fmt.Sprintf("[ -n \"$WAN_INTERFACE\" ] && %s -A KAMATERA-FIREWALL ! -i \"$WAN_INTERFACE\" -j RETURN\n", iptables)
+	}
+	script += fmt.Sprintf("%s -A KAMATERA-FIREWALL -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN\n", iptables) +
+		fmt.Sprintf("%s -A KAMATERA-FIREWALL -p %s -j RETURN\n", iptables, icmp)
+	for _, rule := range rules {
+		if rule.Source != "" && rule.isIPv6() != ipv6 {
+			continue
+		}
+		script += fmt.Sprintf("%s -A KAMATERA-FIREWALL %s -j RETURN\n", iptables, rule.iptablesArgs())
+	}
+	script += fmt.Sprintf("%s -A KAMATERA-FIREWALL -j DROP\n", iptables)
+	script += fmt.Sprintf("%s -F KAMATERA-FIREWALL-FORWARD 2>/dev/null || %s -N KAMATERA-FIREWALL-FORWARD\n", iptables, iptables) +
+		fmt.Sprintf("%s -N DOCKER-USER 2>/dev/null\n", iptables) +
+		fmt.Sprintf("%s -C DOCKER-USER -m conntrack --ctstate DNAT -j KAMATERA-FIREWALL-FORWARD 2>/dev/null || %s -I DOCKER-USER -m conntrack --ctstate DNAT -j KAMATERA-FIREWALL-FORWARD\n", iptables, iptables) +
+		fmt.Sprintf("[ -n \"$WAN_INTERFACE\" ] && %s -A KAMATERA-FIREWALL-FORWARD ! -i \"$WAN_INTERFACE\" -j RETURN\n", iptables) +
+		fmt.Sprintf("%s -A KAMATERA-FIREWALL-FORWARD -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN\n", iptables)
+	for _, rule := range rules {
+		if rule.Source != "" && rule.isIPv6() != ipv6 {
+			continue
+		}
+		script += fmt.Sprintf("%s -A KAMATERA-FIREWALL-FORWARD %s -j RETURN\n", iptables, rule.forwardIptablesArgs())
+	}
+	script += fmt.Sprintf("%s -A KAMATERA-FIREWALL-FORWARD -j DROP\n", iptables)
+	return script
+}
+
+const firewallServiceUnit = `[Unit]
+Description=Kamatera docker-machine firewall
+Before=docker.service
+After=network.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/sbin/kamatera-firewall.sh
+RemainAfterExit=yes
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func (d *Driver) applyFirewallRules(client *ssh.Client) error {
+	rules, err := d.getFirewallRules()
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("cat > /usr/local/sbin/kamatera-firewall.sh <<'EOF'\n%sEOF\n", firewallScript(rules, d.PrivateNetworkName != "")) +
+		"chmod +x /usr/local/sbin/kamatera-firewall.sh\n" +
+		fmt.Sprintf("cat > /etc/systemd/system/kamatera-firewall.service <<'EOF'\n%sEOF\n", firewallServiceUnit) +
+		"systemctl daemon-reload && systemctl enable kamatera-firewall.service && systemctl start kamatera-firewall.service\n"
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "Failed to open SSH session for firewall configuration")
+	}
+	defer session.Close()
+	// CombinedOutput serializes the writes, the SSH session copies stdout and stderr concurrently
+	output, err := session.CombinedOutput(cmd)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Failed to apply firewall rules on the Kamatera server: %s", string(output)))
+	}
+	return nil
+}
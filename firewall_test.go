@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetFirewallRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		rules []string
+	}{
+		{"default", []string{"tcp:80"}, []string{"tcp:80", "tcp:22", "tcp:2376"}},
+		{"restricted ssh", []string{"tcp:22:10.0.0.0/8"}, []string{"tcp:22:10.0.0.0/8", "tcp:2376"}},
+		{"port range", []string{"tcp:1-3000:10.0.0.0/8"}, []string{"tcp:1-3000:10.0.0.0/8"}},
+		{"udp", []string{"udp:22"}, []string{"udp:22", "tcp:22", "tcp:2376"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDriver()
+			d.FirewallAllow = test.allow
+			rules, err := d.getFirewallRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual []string
+			for _, rule := range rules {
+				actual = append(actual, rule.String())
+			}
+			if !reflect.DeepEqual(actual, test.rules) {
+				t.Errorf("expected %v, got %v", test.rules, actual)
+			}
+		})
+	}
+}
+
+func TestFirewallScript(t *testing.T) {
+	rules := []FirewallRule{
+		{Protocol: "tcp", Port: "22", Source: "10.0.0.0/8"},
+		{Protocol: "tcp", Port: "80", Source: "2001:db8::/32"},
+		{Protocol: "tcp", Port: "2376"},
+	}
+	script := firewallScript(rules, true)
+	for _, line := range []string{
+		"iptables -A KAMATERA-FIREWALL -p tcp --dport 22 -s 10.0.0.0/8 -j RETURN",
+		"ip6tables -A KAMATERA-FIREWALL -p tcp --dport 80 -s 2001:db8::/32 -j RETURN",
+		"iptables -A KAMATERA-FIREWALL -p tcp --dport 2376 -j RETURN",
+		"ip6tables -A KAMATERA-FIREWALL -p tcp --dport 2376 -j RETURN",
+		`iptables -A KAMATERA-FIREWALL ! -i "$WAN_INTERFACE" -j RETURN`,
+		"ip6tables -A KAMATERA-FIREWALL -j DROP",
+		"iptables -I DOCKER-USER -m conntrack --ctstate DNAT -j KAMATERA-FIREWALL-FORWARD",
+		`iptables -A KAMATERA-FIREWALL-FORWARD ! -i "$WAN_INTERFACE" -j RETURN`,
+		"iptables -A KAMATERA-FIREWALL-FORWARD -p tcp -m conntrack --ctorigdstport 22 -s 10.0.0.0/8 -j RETURN",
+		"ip6tables -A KAMATERA-FIREWALL-FORWARD -p tcp -m conntrack --ctorigdstport 80 -s 2001:db8::/32 -j RETURN",
+		"iptables -A KAMATERA-FIREWALL-FORWARD -j DROP",
+	} {
+		if !strings.Contains(script, line+"\n") {
+			t.Errorf("script does not contain %q:\n%s", line, script)
+		}
+	}
+	for _, line := range []string{
+		"ip6tables -A KAMATERA-FIREWALL -p tcp --dport 22 -s 10.0.0.0/8",
+		"iptables -A KAMATERA-FIREWALL -p tcp --dport 80 -s 2001:db8::/32",
+		"iptables -A KAMATERA-FIREWALL-FORWARD -p tcp -m conntrack --ctorigdstport 80 -s 2001:db8::/32",
+	} {
+		if strings.Contains(script, line) {
+			t.Errorf("script contains a rule of the other IP version %q", line)
+		}
+	}
+	if strings.Contains(firewallScript(rules, false), `KAMATERA-FIREWALL ! -i "$WAN_INTERFACE"`) {
+		t.Error("the private network interface is allowed without a private network")
+	}
+}
+
+func TestParseFirewallRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		res  FirewallRule
+	}{
+		{"tcp:80", FirewallRule{Protocol: "tcp", Port: "80"}},
+		{"UDP:53:", FirewallRule{Protocol: "udp", Port: "53"}},
+		{"tcp:8000-8100:10.0.0.0/8", FirewallRule{Protocol: "tcp", Port: "8000-8100", Source: "10.0.0.0/8"}},
+		{"tcp:3000-3000", FirewallRule{Protocol: "tcp", Port: "3000-3000"}},
+		{"tcp:22:2001:db8::/32", FirewallRule{Protocol: "tcp", Port: "22", Source: "2001:db8::/32"}},
+		{"tcp:22:2001:db8::1", FirewallRule{Protocol: "tcp", Port: "22", Source: "2001:db8::1"}},
+		{"udp:1-3000:::/0", FirewallRule{Protocol: "udp", Port: "1-3000", Source: "::/0"}},
+	}
+	for _, test := range tests {
+		res, err := ParseFirewallRule(test.rule)
+		if err != nil {
+			t.Errorf("%s: %s", test.rule, err)
+		} else if res != test.res {
+			t.Errorf("%s: expected %+v, got %+v", test.rule, test.res, res)
+		} else if res.Source != "" && res.isIPv6() != strings.Contains(res.Source, ":") {
+			t.Errorf("%s: unexpected IP version", test.rule)
+		}
+	}
+	for _, rule := range []string{"tcp", "icmp:80", "tcp:0", "tcp:65536", "tcp:3000-1", "tcp:1-2-3", "tcp:22:2001:db8::/129", "tcp:22:10.0.0.0/8:22"} {
+		if _, err := ParseFirewallRule(rule); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// image selectors, in addition to the exact image description
+const (
+	imageSelectorIdPrefix = "id:"
+	imageSelectorLatest   = "latest"
+	// the flavor of an OS selector without one, e.g. ubuntu selects ubuntu_server images and not ubuntu_desktop images
+	imageSelectorDefaultFlavor = "server"
+)
+
+// the tokens which may follow the version in a plain OS image description, images with other tokens (e.g. apps) are selected only by description
+var imageArchitectureTokens = map[string]bool{"32": true, "64": true, "bit": true, "x86": true, "x64": true, "amd64": true, "arm64": true, "aarch64": true}
+
+var imageVersionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+var imageDeprecatedPattern = regexp.MustCompile(`\b(deprecated|eol|end of life)\b`)
+var imageConstraintPattern = regexp.MustCompile(`^(>=|<=|>|<|=)?\s*([0-9]+(\.[0-9]+)*)$`)
+
+// ImageSelector selects a disk image by OS name and version constraint, e.g. ubuntu:>=22.04 or debian:latest
+// Os is the description prefix before the version, an OS without a flavor matches the default flavor or images without a flavor
+type ImageSelector struct {
+	Os       string
+	Operator string
+	Version  string
+}
+
+// ParseImageVersion returns the OS name with the flavor and the version from a disk image description
+// e.g. ubuntu_server and 22.04 from ubuntu_server_22.04_64-bit
+// returns an empty version if the description doesn't contain one, or if it contains more than the architecture after the version
+// the deprecation markers are ignored, deprecated images are handled by SelectDiskImage
+func ParseImageVersion(description string) (string, string) {
+	description = imageDeprecatedPattern.ReplaceAllString(strings.ToLower(description), " ")
+	parts := strings.FieldsFunc(description, func(r rune) bool {
+		return r == '_' || r == '-' || r == ' '
+	})
+	if len(parts) == 0 {
+		return "", ""
+	}
+	for i, part := range parts[1:] {
+		if !imageVersionPattern.MatchString(part) {
+			continue
+		}
+		os := strings.Join(parts[:i+1], "_")
+		for _, suffix := range parts[i+2:] {
+			if !imageArchitectureTokens[suffix] {
+				return os, ""
+			}
+		}
+		return os, part
+	}
+	return strings.Join(parts, "_"), ""
+}
+
+// CompareImageVersions compares dotted numeric versions, returns -1, 0 or 1
+func CompareImageVersions(a string, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aNum, bNum := 0, 0
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+		if aNum < bNum {
+			return -1
+		} else if aNum > bNum {
+			return 1
+		}
+	}
+	return 0
+}
+
+// ParseImageSelector returns nil if the image is not an OS:VERSION selector, in which case it is an image description
+// or an id:IMAGE_ID (image IDs contain colons, e.g. id:EU:6000C29...)
+func ParseImageSelector(image string) (*ImageSelector, error) {
+	if strings.HasPrefix(image, imageSelectorIdPrefix) {
+		return nil, nil
+	}
+	parts := strings.SplitN(image, ":", 2)
+	if len(parts) != 2 || strings.ContainsAny(parts[0], " ") || parts[0] == "" {
+		return nil, nil
+	}
+	selector := &ImageSelector{Os: strings.ToLower(strings.Replace(parts[0], "-", "_", -1))}
+	constraint := strings.TrimSpace(parts[1])
+	if constraint == imageSelectorLatest {
+		return selector, nil
+	}
+	match := imageConstraintPattern.FindStringSubmatch(constraint)
+	if match == nil {
+		return nil, errors.New(fmt.Sprintf("Invalid image selector: %s (expected OS[_FLAVOR]:latest, OS[_FLAVOR]:VERSION or OS[_FLAVOR]:>=VERSION)", image))
+	}
+	selector.Operator = match[1]
+	if selector.Operator == "" {
+		selector.Operator = "="
+	}
+	selector.Version = match[2]
+	return selector, nil
+}
+
+// ValidateImage validates the --kamatera-image value before the datacenter images are known
+func ValidateImage(image string) error {
+	if strings.HasPrefix(image, imageSelectorIdPrefix) {
+		if strings.TrimSpace(strings.TrimPrefix(image, imageSelectorIdPrefix)) == "" {
+			return errors.New(fmt.Sprintf("Invalid disk image: %s (expected id:IMAGE_ID)", image))
+		}
+		return nil
+	}
+	_, err := ParseImageSelector(image)
+	return err
+}
+
+func (s *ImageSelector) Matches(os string, version string) bool {
+	if version == "" {
+		return false
+	}
+	if os != s.Os && (strings.Contains(s.Os, "_") || os != s.Os+"_"+imageSelectorDefaultFlavor) {
+		return false
+	}
+	if s.Version == "" {
+		return true
+	}
+	cmp := CompareImageVersions(version, s.Version)
+	switch s.Operator {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	default:
+		// 22 matches 22.04, 22.04 matches only 22.04
+		return strings.HasPrefix(version+".", s.Version+".")
+	}
+}
+
+func IsImageDeprecated(description string) bool {
+	return imageDeprecatedPattern.MatchString(strings.ToLower(description))
+}
+
+// SelectDiskImage selects a disk image from the datacenter images by description, OS:VERSION selector or id:IMAGE_ID
+// account-private images are listed with the datacenter images, and can also be used by ID if they are not listed
+func SelectDiskImage(image string, diskImages []KamateraDiskImage) (*KamateraDiskImage, error) {
+	if strings.HasPrefix(image, imageSelectorIdPrefix) {
+		id := strings.TrimSpace(strings.TrimPrefix(image, imageSelectorIdPrefix))
+		if id == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid disk image: %s", image))
+		}
+		for i := range diskImages {
+			if diskImages[i].Id == id {
+				return &diskImages[i], nil
+			}
+		}
+		return &KamateraDiskImage{Id: id}, nil
+	}
+	for i := range diskImages {
+		if diskImages[i].Description == image {
+			return &diskImages[i], nil
+		}
+	}
+	selector, err := ParseImageSelector(image)
+	if err != nil {
+		return nil, err
+	}
+	if selector == nil {
+		return nil, errors.New(fmt.Sprintf("Invalid disk image: %s", image))
+	}
+	// the highest matching version is selected, deprecated images are selected only if nothing else matches
+	// images with the same version are ordered by description, so that the selection doesn't depend on the list order
+	var selected *KamateraDiskImage
+	selectedVersion := ""
+	for i := range diskImages {
+		os, version := ParseImageVersion(diskImages[i].Description)
+		if !selector.Matches(os, version) {
+			continue
+		}
+		if selected != nil {
+			selectedDeprecated := IsImageDeprecated(selected.Description)
+			deprecated := IsImageDeprecated(diskImages[i].Description)
+			if deprecated && !selectedDeprecated {
+				continue
+			}
+			if deprecated == selectedDeprecated {
+				cmp := CompareImageVersions(version, selectedVersion)
+				if cmp < 0 || (cmp == 0 && diskImages[i].Description >= selected.Description) {
+					continue
+				}
+			}
+		}
+		selected = &diskImages[i]
+		selectedVersion = version
+	}
+	if selected == nil {
+		return nil, errors.New(fmt.Sprintf("No disk image matches %s", image))
+	}
+	return selected, nil
+}
+
+// selectDiskImage sets the disk image ID of the selected datacenter
+func (d *Driver) selectDiskImage(diskImages []KamateraDiskImage) error {
+	diskImage, err := SelectDiskImage(d.Image, diskImages)
+	if err != nil {
+		return err
+	}
+	d.DiskImageId = diskImage.Id
+	if diskImage.Description == "" {
+		log.Infof("Using disk image ID %s", diskImage.Id)
+	} else if diskImage.Description != d.Image {
+		log.Infof("Using disk image %s (%s)", diskImage.Description, diskImage.Id)
+	}
+	if IsImageDeprecated(diskImage.Description) {
+		log.Warnf("Disk image %s is deprecated, please consider using a newer image", diskImage.Description)
+	}
+	return nil
+}
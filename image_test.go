@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+// setConfigFromArgs parses the driver create flags like the cluster command and sets the driver config from them
+func setConfigFromArgs(d *Driver, args ...string) error {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	opts := addDriverFlags(fs, d.GetCreateFlags())
+	if err := fs.Parse(append([]string{"--kamatera-api-client-id", "client", "--kamatera-api-secret", "secret"}, args...)); err != nil {
+		return err
+	}
+	return d.SetConfigFromFlags(opts)
+}
+
+func TestSetConfigFromFlagsImage(t *testing.T) {
+	for _, image := range []string{"id:EU:6000C29a5a7c12ab34cd56ef78901234", "id:12345", "ubuntu:latest", "ubuntu:>=22.04", "ubuntu_server_22.04_64-bit"} {
+		d := NewDriver()
+		if err := setConfigFromArgs(d, "--kamatera-image", image); err != nil {
+			t.Errorf("%s: %s", image, err)
+		} else if d.Image != image {
+			t.Errorf("%s: unexpected image %s", image, d.Image)
+		}
+	}
+	for _, image := range []string{"id:", "id: ", "ubuntu:foo"} {
+		if err := setConfigFromArgs(NewDriver(), "--kamatera-image", image); err == nil {
+			t.Errorf("%s: expected an error", image)
+		}
+	}
+}
+
+func TestSelectDiskImageById(t *testing.T) {
+	diskImages := []KamateraDiskImage{
+		{Id: "EU:6000C29a5a7c12ab34cd56ef78901234", Description: "ubuntu_server_22.04_64-bit"},
+		{Id: "EU:6000C29b", Description: "debian_server_12_64-bit"},
+	}
+	for image, id := range map[string]string{
+		"id:EU:6000C29a5a7c12ab34cd56ef78901234": "EU:6000C29a5a7c12ab34cd56ef78901234",
+		"id:EU:private-image":                    "EU:private-image",
+		"ubuntu:22.04":                           "EU:6000C29a5a7c12ab34cd56ef78901234",
+	} {
+		diskImage, err := SelectDiskImage(image, diskImages)
+		if err != nil {
+			t.Errorf("%s: %s", image, err)
+		} else if diskImage.Id != id {
+			t.Errorf("%s: expected image ID %s, got %s", image, id, diskImage.Id)
+		}
+	}
+}
+
+func TestParseImageVersion(t *testing.T) {
+	for description, expected := range map[string][2]string{
+		"ubuntu_server_22.04_64-bit":        {"ubuntu_server", "22.04"},
+		"ubuntu_desktop_22.04_64-bit":       {"ubuntu_desktop", "22.04"},
+		"debian_12_64-bit":                  {"debian", "12"},
+		"ubuntu_server_22.04_64-bit_docker": {"ubuntu_server", ""},
+		"apps_wordpress_6.4_ubuntu":         {"apps_wordpress", ""},
+		"custom_image":                      {"custom_image", ""},
+	} {
+		os, version := ParseImageVersion(description)
+		if os != expected[0] || version != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s", description, expected, os, version)
+		}
+	}
+}
+
+func TestSelectDiskImage(t *testing.T) {
+	diskImages := []KamateraDiskImage{
+		{Id: "desktop-24.04", Description: "ubuntu_desktop_24.04_64-bit"},
+		{Id: "docker-24.04", Description: "ubuntu_server_24.04_64-bit_docker"},
+		{Id: "ubuntu-18.04", Description: "ubuntu_server_18.04_64-bit"},
+		{Id: "ubuntu-22.04", Description: "ubuntu_server_22.04_64-bit"},
+		{Id: "ubuntu-22.10", Description: "ubuntu_server_22.10_64-bit"},
+		{Id: "ubuntu-20.04", Description: "ubuntu_server_20.04_64-bit"},
+		{Id: "ubuntu-23.04", Description: "ubuntu_server_23.04_64-bit deprecated"},
+		{Id: "debian-12-x64", Description: "debian_12_x64"},
+		{Id: "debian-12", Description: "debian_12_64-bit"},
+		{Id: "debian-11", Description: "debian_11_64-bit"},
+		{Id: "centos-7", Description: "centos_server_7.9_64-bit eol"},
+	}
+	for image, id := range map[string]string{
+		"ubuntu:latest":                     "ubuntu-22.10",
+		"ubuntu:22":                         "ubuntu-22.10",
+		"ubuntu:=22.04":                     "ubuntu-22.04",
+		"ubuntu:>=20.04":                    "ubuntu-22.10",
+		"ubuntu:>22.10":                     "ubuntu-23.04",
+		"ubuntu:<22":                        "ubuntu-20.04",
+		"ubuntu:<=22.04":                    "ubuntu-22.04",
+		"ubuntu_desktop:latest":             "desktop-24.04",
+		"ubuntu-desktop:24.04":              "desktop-24.04",
+		"debian:latest":                     "debian-12",
+		"centos:7":                          "centos-7",
+		"ubuntu_server_24.04_64-bit_docker": "docker-24.04",
+		defaultImage:                        "ubuntu-22.04",
+	} {
+		diskImage, err := SelectDiskImage(image, diskImages)
+		if err != nil {
+			t.Errorf("%s: %s", image, err)
+		} else if diskImage.Id != id {
+			t.Errorf("%s: expected image ID %s, got %s", image, id, diskImage.Id)
+		}
+	}
+	for _, image := range []string{"ubuntu:>=25", "ubuntu:16.04", "fedora:latest", "ubuntu_server_24.04_64-bit"} {
+		if _, err := SelectDiskImage(image, diskImages); err == nil {
+			t.Errorf("%s: expected an error", image)
+		}
+	}
+}
@@ -6,17 +6,36 @@ import (
 	"os"
 
 	"github.com/docker/machine/libmachine/drivers/plugin"
+	"github.com/docker/machine/version"
 )
 
-// Version will be added once we start the build process via travis-ci
+// Version, GitCommit and BuildDate will be added once we start the build process via travis-ci
 var Version string
+var GitCommit string
+var BuildDate string
+
+// GetVersion returns the build version, or "dev" for local builds
+func GetVersion() string {
+	if Version == "" {
+		return "dev"
+	}
+	return Version
+}
 
 func main() {
-	version := flag.Bool("v", false, "prints current docker-machine-driver-kamatera version")
+	if len(os.Args) > 1 && os.Args[1] == "cluster" {
+		os.Exit(RunClusterCommand(os.Args[2:]))
+	}
+	printVersion := flag.Bool("v", false, "prints current docker-machine-driver-kamatera version")
 	flag.Parse()
-	if *version {
-		fmt.Printf("Version: %s\n", Version)
+	if *printVersion {
+		fmt.Printf("Version: %s\n", GetVersion())
+		fmt.Printf("Git commit: %s\n", GitCommit)
+		fmt.Printf("Build date: %s\n", BuildDate)
+		fmt.Printf("libmachine version: %s\n", version.Version)
 		os.Exit(0)
 	}
-	plugin.RegisterDriver(NewDriver())
+	driver := NewDriver()
+	driver.ctx = HandleSignals()
+	plugin.RegisterDriver(driver)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	orphanedServerAdopt     = "adopt"
+	orphanedServerTerminate = "terminate"
+	orphanedServerFail      = "fail"
+)
+
+// Kamatera lists a server only once it is built, a server whose create server request was sent is waited for up to this timeout
+const serverListedTimeout = 15 * time.Minute
+
+var serverListedInterval = 10 * time.Second
+
+// KamateraPendingCreate is saved in the docker-machine store while a server is being created
+// it allows to detect servers which were created by a failed or interrupted create with the same machine name
+type KamateraPendingCreate struct {
+	MachineName           string
+	ServerName            string
+	Password              string
+	Datacenter            string
+	CreateServerCommandId int
+	KamateraServerId      string
+	Started               time.Time
+	// RequestSent is set before the create server request is sent, the server may exist even without a command ID
+	RequestSent time.Time
+}
+
+// the pending create is stored outside of the machine directory, which is deleted by docker-machine rm
+func (d *Driver) getPendingCreatePath() string {
+	return filepath.Join(d.StorePath, "kamatera", "pending", fmt.Sprintf("%s.json", d.MachineName))
+}
+
+func (d *Driver) savePendingCreate() error {
+	path := d.getPendingCreatePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "Failed to create Kamatera pending create directory")
+	}
+	buf, err := json.Marshal(KamateraPendingCreate{
+		MachineName:           d.MachineName,
+		ServerName:            d.ServerName,
+		Password:              d.Password,
+		Datacenter:            d.Datacenter,
+		CreateServerCommandId: d.CreateServerCommandId,
+		KamateraServerId:      d.KamateraServerId,
+		Started:               time.Now(),
+		RequestSent:           d.createRequestSent,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		return errors.Wrap(err, "Failed to save Kamatera pending create")
+	}
+	log.Debugf("Saved pending create to %s", path)
+	return nil
+}
+
+// loadPendingCreate returns nil if there is no pending create for this machine
+func (d *Driver) loadPendingCreate() (*KamateraPendingCreate, error) {
+	buf, err := ioutil.ReadFile(d.getPendingCreatePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Failed to read Kamatera pending create")
+	}
+	var pending KamateraPendingCreate
+	if err := json.Unmarshal(buf, &pending); err != nil {
+		return nil, errors.Wrap(err, "Invalid Kamatera pending create")
+	}
+	return &pending, nil
+}
+
+func (d *Driver) removePendingCreate() {
+	if err := os.Remove(d.getPendingCreatePath()); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove Kamatera pending create: %s", err)
+	}
+}
+
+// checkPendingCreate handles a server left over by a previous create with the same machine name
+// returns true if the server was adopted, in which case the create server request should be skipped
+func (d *Driver) checkPendingCreate() (bool, error) {
+	pending, err := d.loadPendingCreate()
+	if err != nil || pending == nil {
+		return false, err
+	}
+	log.Infof("Found a pending create from %s (server name = %s, command ID = %d)", pending.Started, pending.ServerName, pending.CreateServerCommandId)
+	server, err := d.getKamateraServerByName(pending.ServerName)
+	if err != nil {
+		return false, err
+	}
+	if server == nil && pending.CreateServerCommandId == 0 {
+		if pending.RequestSent.IsZero() {
+			// the previous create stopped before the create server request was sent
+			log.Infof("Server %s was not created, continuing with a new create", pending.ServerName)
+			d.removePendingCreate()
+			return false, nil
+		}
+		// the create server request was sent, the server is listed only once it is built
+		if d.OrphanedServer == orphanedServerFail {
+			return false, d.serverNotListedError(pending.ServerName, pending.RequestSent)
+		}
+		if server, err = d.waitForServerListed(pending.ServerName, pending.RequestSent); err != nil {
+			return false, err
+		}
+		if server == nil {
+			return false, d.serverNotListedError(pending.ServerName, pending.RequestSent)
+		}
+	}
+	switch d.OrphanedServer {
+	case orphanedServerFail:
+		return false, errors.New(fmt.Sprintf("Kamatera server %s was created by a previous attempt, use --%s=%s to continue using it or --%s=%s to terminate it", pending.ServerName, flagOrphanedServer, orphanedServerAdopt, flagOrphanedServer, orphanedServerTerminate))
+	case orphanedServerTerminate:
+		if server == nil {
+			return false, errors.New(fmt.Sprintf("Kamatera server %s is still being created (command ID = %d), please wait for it to complete and retry", pending.ServerName, pending.CreateServerCommandId))
+		}
+		log.Infof("Terminating Kamatera server %s which was created by a previous attempt", pending.ServerName)
+		d.ServerName = pending.ServerName
+		d.KamateraServerId = server.Id
+		if err := d.Remove(); err != nil {
+			return false, errors.Wrap(err, "Failed to terminate Kamatera server created by a previous attempt")
+		}
+		d.ServerName = ""
+		d.KamateraServerId = ""
+		d.removePendingCreate()
+		return false, nil
+	}
+	log.Infof("Adopting Kamatera server %s which was created by a previous attempt", pending.ServerName)
+	d.ServerName = pending.ServerName
+	d.Password = pending.Password
+	d.CreateServerCommandId = pending.CreateServerCommandId
+	d.createRequestSent = pending.RequestSent
+	if pending.KamateraServerId != "" {
+		d.KamateraServerId = pending.KamateraServerId
+	}
+	if server != nil {
+		d.KamateraServerId = server.Id
+		if d.CreateServerCommandId == 0 {
+			info, err := d.getKamateraServerInfo(d.ServerName)
+			if err != nil {
+				return false, err
+			}
+			d.IPAddress = info.GetPublicIp()
+			if d.IPAddress == "" {
+				return false, errors.New(fmt.Sprintf("Failed to get the public IP of Kamatera server %s", d.ServerName))
+			}
+		}
+	}
+	return true, nil
+}
+
+// waitForServerListed waits until a server whose create server request was sent at requestSent is listed
+// returns nil if the server was not listed within serverListedTimeout of the request
+func (d *Driver) waitForServerListed(serverName string, requestSent time.Time) (*KamateraServerListInfo, error) {
+	for {
+		server, err := d.getKamateraServerByName(serverName)
+		if err != nil || server != nil {
+			return server, err
+		}
+		if time.Since(requestSent) > serverListedTimeout {
+			return nil, nil
+		}
+		log.Infof("Waiting for Kamatera server %s, which may have been created by a previous create server request, to be listed...", serverName)
+		if err := d.sleep(serverListedInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *Driver) serverNotListedError(serverName string, requestSent time.Time) error {
+	return errors.New(fmt.Sprintf("The create server request for Kamatera server %s was sent at %s, but the server is not listed. "+
+		"Please check the Kamatera console and retry when the server is listed (it is handled according to --%s), "+
+		"or delete %s if the server was not created", serverName, requestSent.Format(time.RFC3339), flagOrphanedServer, d.getPendingCreatePath()))
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// let Kamatera choose the private network IP, instead of allocating it in the driver
+const privateNetworkIpAuto = "auto"
+
+// a private network create marker older than this is assumed to be left by a killed process
+const privateNetworkCreateTimeout = 15 * time.Minute
+
+// IPRange is an inclusive range of IPv4 addresses, parsed from a CIDR or a FIRST-LAST range
+type IPRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+func ParseIPRange(s string) (*IPRange, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, errors.New(fmt.Sprintf("Invalid IP range: %s (expected an IPv4 CIDR or FIRST-LAST)", s))
+		}
+		first := ipNet.IP.To4()
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^ipNet.Mask[i]
+		}
+		return &IPRange{First: first, Last: last}, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, errors.New(fmt.Sprintf("Invalid IP range: %s (expected an IPv4 CIDR or FIRST-LAST)", s))
+	}
+	first := net.ParseIP(strings.TrimSpace(parts[0])).To4()
+	last := net.ParseIP(strings.TrimSpace(parts[1])).To4()
+	if first == nil || last == nil || bytes.Compare(first, last) > 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid IP range: %s (expected an IPv4 CIDR or FIRST-LAST)", s))
+	}
+	return &IPRange{First: first, Last: last}, nil
+}
+
+func (r *IPRange) Contains(ip net.IP) bool {
+	ip = ip.To4()
+	return ip != nil && bytes.Compare(ip, r.First) >= 0 && bytes.Compare(ip, r.Last) <= 0
+}
+
+// GetAvailablePrivateNetworkIps returns the IPs which can be allocated, in the order of the available IPs
+// IPs which are used or outside of the range (if not nil) are excluded
+func GetAvailablePrivateNetworkIps(available []string, used []string, ipRange *IPRange) ([]string, error) {
+	usedIps := map[string]bool{}
+	for _, ipStr := range used {
+		if ip := net.ParseIP(strings.TrimSpace(ipStr)); ip != nil {
+			usedIps[ip.String()] = true
+		}
+	}
+	seen := map[string]bool{}
+	var res []string
+	for _, ipStr := range available {
+		ip := net.ParseIP(strings.TrimSpace(ipStr))
+		if ip == nil {
+			return nil, errors.New(fmt.Sprintf("Invalid private network IP from Kamatera: %q", ipStr))
+		}
+		ipStr = ip.String()
+		if usedIps[ipStr] || seen[ipStr] {
+			continue
+		}
+		if ipRange != nil && !ipRange.Contains(ip) {
+			continue
+		}
+		seen[ipStr] = true
+		res = append(res, ipStr)
+	}
+	return res, nil
+}
+
+// AllocatePrivateNetworkIp picks a random IP from the given IPs, returns the IP and the remaining IPs
+func AllocatePrivateNetworkIp(ips []string, rnd *rand.Rand) (string, []string, error) {
+	if len(ips) == 0 {
+		return "", nil, errors.New("No available private network IPs")
+	}
+	i := rnd.Intn(len(ips))
+	var remaining []string
+	remaining = append(remaining, ips[:i]...)
+	remaining = append(remaining, ips[i+1:]...)
+	return ips[i], remaining, nil
+}
+
+// getLocalPrivateNetworkIps returns the private network IPs of other Kamatera machines in the docker-machine store
+// which use the same datacenter and private network
+func (d *Driver) getLocalPrivateNetworkIps() ([]string, error) {
+	machinesPath := filepath.Join(d.StorePath, "machines")
+	dirs, err := ioutil.ReadDir(machinesPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Failed to list docker-machine machines")
+	}
+	var ips []string
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == d.MachineName {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(machinesPath, dir.Name(), "config.json"))
+		if err != nil {
+			continue
+		}
+		var config struct {
+			DriverName string
+			Driver     struct {
+				Datacenter         string
+				PrivateNetworkName string
+				PrivateNetworkIp   string
+			}
+		}
+		if err := json.Unmarshal(buf, &config); err != nil {
+			log.Debugf("Ignoring invalid machine config %s: %s", dir.Name(), err)
+			continue
+		}
+		if config.DriverName != "kamatera" || config.Driver.Datacenter != d.Datacenter || config.Driver.PrivateNetworkName != d.PrivateNetworkName {
+			continue
+		}
+		if ip := net.ParseIP(config.Driver.PrivateNetworkIp); ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips, nil
+}
+
+// allocatePrivateNetworkIp validates the private network and allocates an IP, unless an IP was requested explicitly
+// a missing private network is only created by Create, after all the create options are validated
+func (d *Driver) allocatePrivateNetworkIp(networks []KamateraNetwork) error {
+	network := findPrivateNetwork(networks, d.PrivateNetworkName)
+	d.privateNetworkMissing = false
+	if network == nil && d.PrivateNetworkCreate {
+		log.Infof("Private network %s does not exist, it will be created with subnet %s", d.PrivateNetworkName, d.PrivateNetworkSubnet)
+		d.privateNetworkMissing = true
+		return nil
+	}
+	if network == nil {
+		return errors.New(fmt.Sprintf("Invalid private network name: %s (use --%s to create it)", d.PrivateNetworkName, flagPrivateNetworkCreate))
+	}
+	return d.allocatePrivateNetworkIpFrom(network)
+}
+
+// createMissingPrivateNetwork creates the private network if it didn't exist when the create options were validated
+// and allocates the private network IP from it
+func (d *Driver) createMissingPrivateNetwork() error {
+	if !d.privateNetworkMissing {
+		return nil
+	}
+	network, err := d.createPrivateNetwork()
+	if err != nil {
+		return err
+	}
+	d.privateNetworkMissing = false
+	return d.allocatePrivateNetworkIpFrom(network)
+}
+
+// allocatePrivateNetworkIpFrom allocates an IP from the private network, unless an IP was requested explicitly
+// the remaining available IPs are kept to retry with a different IP if Kamatera rejects the allocated one
+func (d *Driver) allocatePrivateNetworkIpFrom(network *KamateraNetwork) error {
+	if d.PrivateNetworkIp == privateNetworkIpAuto {
+		return nil
+	}
+	used, err := d.getLocalPrivateNetworkIps()
+	if err != nil {
+		return err
+	}
+	var ipRange *IPRange
+	if d.PrivateNetworkIpRange != "" {
+		if ipRange, err = ParseIPRange(d.PrivateNetworkIpRange); err != nil {
+			return err
+		}
+	}
+	if d.PrivateNetworkIp != "" {
+		if IsStringInArray(d.PrivateNetworkIp, used) {
+			return errors.New(fmt.Sprintf("Private network IP %s is used by another machine", d.PrivateNetworkIp))
+		}
+		if !IsStringInArray(d.PrivateNetworkIp, network.Ips) {
+			log.Warnf("Private network IP %s is not in the available IPs of private network %s", d.PrivateNetworkIp, d.PrivateNetworkName)
+		}
+		return nil
+	}
+	ips, err := GetAvailablePrivateNetworkIps(network.Ips, used, ipRange)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return errors.New(fmt.Sprintf("No available IPs in private network %s", d.PrivateNetworkName))
+	}
+	d.PrivateNetworkIps = ips
+	d.GetPrivateNetworkIp()
+	return nil
+}
+
+func findPrivateNetwork(networks []KamateraNetwork, name string) *KamateraNetwork {
+	for i := range networks {
+		if networks[i].Name == name {
+			return &networks[i]
+		}
+	}
+	return nil
+}
+
+// ValidatePrivateNetworkCreate validates the subnet, gateway and DNS options used to create a private network
+func ValidatePrivateNetworkCreate(subnet string, gateway string, dns []string) error {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return errors.New(fmt.Sprintf("Invalid --%s: %s (expected an IPv4 CIDR, e.g. 172.16.0.0/23)", flagPrivateNetworkSubnet, subnet))
+	}
+	if gateway != "" {
+		if ip := net.ParseIP(gateway); ip == nil || !ipNet.Contains(ip) {
+			return errors.New(fmt.Sprintf("Invalid --%s: %s (must be an IP in subnet %s)", flagPrivateNetworkGateway, gateway, subnet))
+		}
+	}
+	if len(dns) > 2 {
+		return errors.New(fmt.Sprintf("Too many --%s values, Kamatera supports up to 2 DNS servers", flagPrivateNetworkDns))
+	}
+	for _, server := range dns {
+		if net.ParseIP(server) == nil {
+			return errors.New(fmt.Sprintf("Invalid --%s: %s", flagPrivateNetworkDns, server))
+		}
+	}
+	return nil
+}
+
+// createPrivateNetwork creates the private network (VLAN) and waits until it is available in the server options
+// getPrivateNetworkCreatePath returns the path of the marker which is saved in the docker-machine store while the private network is created
+func (d *Driver) getPrivateNetworkCreatePath() string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(fmt.Sprintf("%s-%s", d.Datacenter, d.PrivateNetworkName))
+	return filepath.Join(d.StorePath, "kamatera", "networks", name+".creating")
+}
+
+// claimPrivateNetworkCreate saves the private network create marker, unless another process saved it and didn't finish yet
+// returns a function which removes the marker if it was saved, or nil if another process is creating the private network
+func claimPrivateNetworkCreate(markerPath string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(markerPath), 0700); err != nil {
+		return nil, errors.Wrap(err, "Failed to create Kamatera private networks directory")
+	}
+	unlock, err := lockFile(markerPath + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if info, err := os.Stat(markerPath); err == nil && time.Since(info.ModTime()) < privateNetworkCreateTimeout {
+		return nil, nil
+	}
+	if err := ioutil.WriteFile(markerPath, []byte(time.Now().Format(time.RFC3339)), 0600); err != nil {
+		return nil, errors.Wrap(err, "Failed to save the Kamatera private network create marker")
+	}
+	return func() { os.Remove(markerPath) }, nil
+}
+
+// createPrivateNetwork creates the private network, or waits for it if another docker-machine process using the same store creates it
+// the private networks are listed again before the create, in case another process created the network since the create options were validated
+func (d *Driver) createPrivateNetwork() (*KamateraNetwork, error) {
+	_, ipNet, err := net.ParseCIDR(d.PrivateNetworkSubnet)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Invalid --%s", flagPrivateNetworkSubnet))
+	}
+	release, err := claimPrivateNetworkCreate(d.getPrivateNetworkCreatePath())
+	if err != nil {
+		return nil, err
+	}
+	if release == nil {
+		log.Infof("Private network %s is being created by another docker-machine process, waiting for it", d.PrivateNetworkName)
+		return d.waitForPrivateNetwork()
+	}
+	defer release()
+	network, ok, err := d.getPrivateNetwork(1)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Failed to check if private network %s was created by another docker-machine process", d.PrivateNetworkName))
+	}
+	if network != nil {
+		log.Infof("Private network %s was created by another docker-machine process", d.PrivateNetworkName)
+		return d.waitForPrivateNetwork()
+	}
+	subnetBit, _ := ipNet.Mask.Size()
+	formData := map[string]string{
+		"datacenter": d.Datacenter,
+		"name":       d.PrivateNetworkName,
+		"subnetIp":   ipNet.IP.String(),
+		"subnetBit":  fmt.Sprintf("%d", subnetBit),
+		"gateway":    d.PrivateNetworkGateway,
+	}
+	for i, server := range d.PrivateNetworkDns {
+		formData[fmt.Sprintf("dns%d", i+1)] = server
+	}
+	log.Infof("Creating private network %s in datacenter %s (subnet %s)", d.PrivateNetworkName, d.Datacenter, d.PrivateNetworkSubnet)
+	span := d.startAPISpan("create-network", 1)
+	resp, err := d.newRequest().
+		SetHeader("AuthClientId", d.APIClientID).
+		SetHeader("AuthSecret", d.APISecret).
+		SetFormData(formData).
+		Post("https://console.kamatera.com/service/network/create")
+	span.endResty(resp, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create Kamatera private network")
+	}
+	if IsAuthErrorStatusCode(resp.StatusCode()) {
+		return nil, KamateraAuthError(resp.StatusCode())
+	}
+	if resp.StatusCode() != 200 {
+		return nil, errors.New(fmt.Sprintf("Failed to create Kamatera private network, status code %d: %s", resp.StatusCode(), resp.String()))
+	}
+	// the response is either a command ID or a list of command IDs
+	var commandIds []int
+	if err := json.Unmarshal(resp.Body(), &commandIds); err != nil {
+		var commandId int
+		if err := json.Unmarshal(resp.Body(), &commandId); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid Kamatera create network response: %s", resp.String()))
+		}
+		commandIds = []int{commandId}
+	}
+	for _, commandId := range commandIds {
+		log.Infof("Waiting for Kamatera create network command %d", commandId)
+		if err := d.waitForKamateraCommand(commandId); err != nil {
+			return nil, errors.Wrap(err, "Failed to create Kamatera private network")
+		}
+	}
+	return d.waitForPrivateNetwork()
+}
+
+// waitForPrivateNetwork waits for the private network to be listed with available IPs
+// getPrivateNetwork returns the private network from the Kamatera server options, or nil if it is not listed
+// returns false if Kamatera responded with an unexpected status code, so that the caller may retry
+func (d *Driver) getPrivateNetwork(attempt int) (*KamateraNetwork, bool, error) {
+	span := d.startAPISpan("get-server-options", attempt)
+	resp, err := d.newRequest().
+		SetHeader("AuthClientId", d.APIClientID).
+		SetHeader("AuthSecret", d.APISecret).
+		Get("https://console.kamatera.com/service/server")
+	span.endResty(resp, err)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Failed to get Kamatera private networks")
+	}
+	if IsAuthErrorStatusCode(resp.StatusCode()) {
+		return nil, false, KamateraAuthError(resp.StatusCode())
+	}
+	if resp.StatusCode() != 200 {
+		log.Debugf("Failed to get Kamatera private networks, status code %d", resp.StatusCode())
+		return nil, false, nil
+	}
+	var res KamateraServerOptions
+	if err := DecodeKamateraResponse("server options", resp.Body(), &res, "networks{}[].name"); err != nil {
+		return nil, false, err
+	}
+	return findPrivateNetwork(res.Networks[d.Datacenter], d.PrivateNetworkName), true, nil
+}
+
+func (d *Driver) waitForPrivateNetwork() (*KamateraNetwork, error) {
+	i := 0
+	for {
+		i += 1
+		network, _, err := d.getPrivateNetwork(i)
+		if err != nil {
+			return nil, err
+		}
+		if network != nil && len(network.Ips) > 0 {
+			log.Infof("Private network %s is ready", d.PrivateNetworkName)
+			return network, nil
+		}
+		if i >= 30 {
+			return nil, errors.New(fmt.Sprintf("Timed out waiting for private network %s to be available", d.PrivateNetworkName))
+		}
+		log.Debugf("Waiting for private network %s to be available... %d/30", d.PrivateNetworkName, i)
+		if err := d.sleep(5 * time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
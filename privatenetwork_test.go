@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// randomPrivateNetworkIps returns random IPs in 172.16.0.0/24, with duplicates and surrounding whitespace
+func randomPrivateNetworkIps(rnd *rand.Rand, n int) []string {
+	var ips []string
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("172.16.0.%d", rnd.Intn(256))
+		if rnd.Intn(10) == 0 {
+			ip = " " + ip + " "
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func TestPrivateNetworkIpAllocationProperties(t *testing.T) {
+	ipRange, err := ParseIPRange("172.16.0.64/26")
+	if err != nil {
+		t.Fatal(err)
+	}
+	property := func(seed int64, numAvailable uint8, numUsed uint8, useRange bool) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		available := randomPrivateNetworkIps(rnd, int(numAvailable))
+		used := randomPrivateNetworkIps(rnd, int(numUsed)%64)
+		var r *IPRange
+		if useRange {
+			r = ipRange
+		}
+		ips, err := GetAvailablePrivateNetworkIps(available, used, r)
+		if err != nil {
+			t.Logf("unexpected error: %s", err)
+			return false
+		}
+		usedIps := map[string]bool{}
+		for _, ip := range used {
+			usedIps[net.ParseIP(strings.TrimSpace(ip)).String()] = true
+		}
+		availableIps := map[string]bool{}
+		for _, ip := range available {
+			availableIps[net.ParseIP(strings.TrimSpace(ip)).String()] = true
+		}
+		// allocate until exhausted, every allocation must be available, unused, in range and distinct
+		allocated := map[string]bool{}
+		remaining := ips
+		for len(remaining) > 0 {
+			var ip string
+			ip, remaining, err = AllocatePrivateNetworkIp(remaining, rnd)
+			if err != nil {
+				t.Logf("unexpected error with %d remaining IPs: %s", len(remaining), err)
+				return false
+			}
+			if !availableIps[ip] || usedIps[ip] || allocated[ip] || (r != nil && !r.Contains(net.ParseIP(ip))) {
+				t.Logf("invalid allocation: %s", ip)
+				return false
+			}
+			allocated[ip] = true
+		}
+		if len(allocated) != len(ips) {
+			t.Logf("allocated %d IPs out of %d", len(allocated), len(ips))
+			return false
+		}
+		if _, _, err := AllocatePrivateNetworkIp(remaining, rnd); err == nil {
+			t.Log("allocation succeeded with no remaining IPs")
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAssignClusterPrivateNetworkIpsProperties(t *testing.T) {
+	property := func(seed int64, numNodes uint8, numIps uint8) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		nodes := make([]*Driver, int(numNodes)%10+1)
+		for i := range nodes {
+			nodes[i] = NewDriver()
+			nodes[i].PrivateNetworkName = "lan-1"
+		}
+		ips, _ := GetAvailablePrivateNetworkIps(randomPrivateNetworkIps(rnd, int(numIps)%20), nil, nil)
+		first, remaining, err := AllocatePrivateNetworkIp(ips, rnd)
+		if err != nil {
+			first, remaining = "", nil
+		}
+		nodes[0].PrivateNetworkIp = first
+		nodes[0].PrivateNetworkIps = remaining
+		err = assignClusterPrivateNetworkIps(nodes)
+		if first == "" || len(ips) < len(nodes) {
+			// there is no IP for every node
+			if len(nodes) > 1 && err == nil {
+				t.Logf("expected an error for %d nodes and %d IPs", len(nodes), len(ips))
+				return false
+			}
+			return true
+		}
+		if err != nil {
+			t.Logf("unexpected error for %d nodes and %d IPs: %s", len(nodes), len(ips), err)
+			return false
+		}
+		// every IP is either the IP of a single node or a retry IP of a single node
+		seen := map[string]bool{}
+		for _, node := range nodes {
+			for _, ip := range append([]string{node.PrivateNetworkIp}, node.PrivateNetworkIps...) {
+				if ip == "" || seen[ip] {
+					t.Logf("IP %q is assigned more than once", ip)
+					return false
+				}
+				seen[ip] = true
+			}
+		}
+		return len(seen) == len(ips)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetAvailablePrivateNetworkIpsInvalid(t *testing.T) {
+	for _, ip := range []string{"", "172.16.0", "not-an-ip", "172.16.0.256"} {
+		if _, err := GetAvailablePrivateNetworkIps([]string{"172.16.0.1", ip}, nil, nil); err == nil {
+			t.Errorf("%q: expected an error", ip)
+		}
+	}
+}
+
+func TestAllocatePrivateNetworkIpDoesNotCreateNetwork(t *testing.T) {
+	d := NewDriver()
+	d.StorePath = t.TempDir()
+	d.PrivateNetworkName = "cluster-lan"
+	d.PrivateNetworkCreate = true
+	d.PrivateNetworkSubnet = "172.16.0.0/24"
+	// the driver has no API credentials, creating the network during validation would fail
+	if err := d.allocatePrivateNetworkIp([]KamateraNetwork{{Name: "other-lan", Ips: []string{"172.16.1.1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if !d.privateNetworkMissing || d.PrivateNetworkIp != "" {
+		t.Fatalf("expected the network to be created later, got missing=%t ip=%q", d.privateNetworkMissing, d.PrivateNetworkIp)
+	}
+	network := KamateraNetwork{Name: "cluster-lan", Ips: []string{"172.16.0.10"}}
+	if err := d.allocatePrivateNetworkIp([]KamateraNetwork{network}); err != nil {
+		t.Fatal(err)
+	}
+	if d.privateNetworkMissing || d.PrivateNetworkIp != "172.16.0.10" {
+		t.Fatalf("expected the existing network to be used, got missing=%t ip=%q", d.privateNetworkMissing, d.PrivateNetworkIp)
+	}
+	if err := d.createMissingPrivateNetwork(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimPrivateNetworkCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kamatera-network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewDriver()
+	d.StorePath = dir
+	d.Datacenter = "EU"
+	d.PrivateNetworkName = "lan"
+	markerPath := d.getPrivateNetworkCreatePath()
+	release, err := claimPrivateNetworkCreate(markerPath)
+	if err != nil || release == nil {
+		t.Fatalf("the first create was not claimed: %v", err)
+	}
+	if other, err := claimPrivateNetworkCreate(markerPath); err != nil || other != nil {
+		t.Fatalf("a concurrent create was claimed: %v", err)
+	}
+	release()
+	release, err = claimPrivateNetworkCreate(markerPath)
+	if err != nil || release == nil {
+		t.Fatalf("the create was not claimed after the previous create finished: %v", err)
+	}
+	stale := time.Now().Add(-2 * privateNetworkCreateTimeout)
+	if err := os.Chtimes(markerPath, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if release, err = claimPrivateNetworkCreate(markerPath); err != nil || release == nil {
+		t.Fatalf("the create was not claimed after the previous create was killed: %v", err)
+	}
+	release()
+	if _, err := os.Stat(markerPath); !os.IsNotExist(err) {
+		t.Errorf("the create marker was not removed: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAPIRateLimit      = 120
+	defaultAPIRateLimitBurst = 10
+
+	// a cross-process lock file older than this is assumed to be left by a killed process
+	rateLimitStaleLockTimeout = 10 * time.Second
+)
+
+// rateLimitState is a token bucket, it is kept in memory or in a file shared between plugin processes
+type rateLimitState struct {
+	Tokens      float64
+	Updated     time.Time
+	PausedUntil time.Time
+}
+
+// take refills the bucket and takes a token
+// returns how long to wait before retrying if there is no available token
+func (s *rateLimitState) take(now time.Time, perSecond float64, burst int) time.Duration {
+	if now.Before(s.PausedUntil) {
+		return s.PausedUntil.Sub(now)
+	}
+	if s.Updated.IsZero() {
+		s.Tokens = float64(burst)
+	} else if now.After(s.Updated) {
+		s.Tokens += now.Sub(s.Updated).Seconds() * perSecond
+	}
+	if s.Tokens > float64(burst) {
+		s.Tokens = float64(burst)
+	}
+	s.Updated = now
+	if s.Tokens >= 1 {
+		s.Tokens -= 1
+		return 0
+	}
+	return time.Duration((1 - s.Tokens) / perSecond * float64(time.Second))
+}
+
+func (s *rateLimitState) pause(until time.Time) {
+	if until.After(s.PausedUntil) {
+		s.PausedUntil = until
+	}
+}
+
+type rateLimiter interface {
+	// take returns how long to wait before a token may be available
+	take() (time.Duration, error)
+	// pause stops all requests until the given time, used to respect Retry-After
+	pause(until time.Time) error
+}
+
+type processRateLimiter struct {
+	mu        sync.Mutex
+	state     rateLimitState
+	perSecond float64
+	burst     int
+}
+
+func (l *processRateLimiter) take() (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.take(time.Now(), l.perSecond, l.burst), nil
+}
+
+func (l *processRateLimiter) pause(until time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state.pause(until)
+	return nil
+}
+
+// fileRateLimiter keeps the token bucket in a file, guarded by a lock file, so that it is shared by all plugin processes using the same store
+type fileRateLimiter struct {
+	path      string
+	perSecond float64
+	burst     int
+}
+
+// lockFile creates the lock file, waiting while another process holds it, returns a function which releases the lock
+func lockFile(lockPath string) (func(), error) {
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		} else if !os.IsExist(err) {
+			return nil, errors.Wrap(err, "Failed to create lock file")
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > rateLimitStaleLockTimeout && removeStaleLockFile(lockPath) {
+			continue
+		}
+		if i >= 1000 {
+			return nil, errors.New(fmt.Sprintf("Timed out waiting for lock file %s", lockPath))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// removeStaleLockFile removes a lock file left by a killed process, returns true if it was removed
+// processes which find the same stale lock file remove it one at a time, and the lock file is checked again before removing it,
+// so that a lock file which another process created after removing the stale lock file is not removed
+func removeStaleLockFile(lockPath string) bool {
+	removePath := lockPath + ".remove"
+	f, err := os.OpenFile(removePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		// another process is removing the stale lock file, unless it was killed while doing so
+		if info, err := os.Stat(removePath); err == nil && time.Since(info.ModTime()) > rateLimitStaleLockTimeout {
+			os.Remove(removePath)
+		}
+		return false
+	}
+	f.Close()
+	defer os.Remove(removePath)
+	if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > rateLimitStaleLockTimeout {
+		log.Debugf("Removing stale lock file %s", lockPath)
+		return os.Remove(lockPath) == nil
+	}
+	return false
+}
+
+func (l *fileRateLimiter) lock() (func(), error) {
+	return lockFile(l.path + ".lock")
+}
+
+func (l *fileRateLimiter) update(fn func(state *rateLimitState) time.Duration) (time.Duration, error) {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return 0, errors.Wrap(err, "Failed to create Kamatera rate limit directory")
+	}
+	unlock, err := l.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	var state rateLimitState
+	if buf, err := ioutil.ReadFile(l.path); err == nil {
+		if err := json.Unmarshal(buf, &state); err != nil {
+			log.Debugf("Ignoring invalid Kamatera rate limit state %s: %s", l.path, err)
+			state = rateLimitState{}
+		}
+	}
+	wait := fn(&state)
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(l.path, buf, 0600); err != nil {
+		return 0, errors.Wrap(err, "Failed to save Kamatera rate limit state")
+	}
+	return wait, nil
+}
+
+func (l *fileRateLimiter) take() (time.Duration, error) {
+	return l.update(func(state *rateLimitState) time.Duration {
+		return state.take(time.Now(), l.perSecond, l.burst)
+	})
+}
+
+func (l *fileRateLimiter) pause(until time.Time) error {
+	_, err := l.update(func(state *rateLimitState) time.Duration {
+		state.pause(until)
+		return 0
+	})
+	return err
+}
+
+var (
+	processRateLimiters   = map[string]*processRateLimiter{}
+	processRateLimitersMu sync.Mutex
+)
+
+// getRateLimiter returns nil if rate limiting is disabled
+// the per-process limiter is shared by all drivers in the process which use the same limits
+func (d *Driver) getRateLimiter() rateLimiter {
+	if d.APIRateLimit <= 0 {
+		return nil
+	}
+	burst := d.APIRateLimitBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	perSecond := float64(d.APIRateLimit) / 60
+	if d.APIRateLimitShared {
+		return &fileRateLimiter{
+			path:      filepath.Join(d.StorePath, "kamatera", "ratelimit.json"),
+			perSecond: perSecond,
+			burst:     burst,
+		}
+	}
+	key := fmt.Sprintf("%d/%d", d.APIRateLimit, burst)
+	processRateLimitersMu.Lock()
+	defer processRateLimitersMu.Unlock()
+	if processRateLimiters[key] == nil {
+		processRateLimiters[key] = &processRateLimiter{perSecond: perSecond, burst: burst}
+	}
+	return processRateLimiters[key]
+}
+
+// waitRateLimit blocks until a token is available or the context is cancelled
+func waitRateLimit(ctx context.Context, limiter rateLimiter) error {
+	for {
+		wait, err := limiter.take()
+		if err != nil {
+			return err
+		}
+		if wait <= 0 {
+			return nil
+		}
+		log.Debugf("Kamatera API rate limit, waiting %s", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// ParseRetryAfter parses a Retry-After header value, which is either a number of seconds or an HTTP date
+func ParseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// rateLimitedTransport waits for the rate limiter before each request
+// and pauses all requests when Kamatera responds with a Retry-After header
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter rateLimiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := waitRateLimit(req.Context(), t.limiter); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if until, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			log.Infof("Kamatera API requested to retry after %s", until.Format(time.RFC3339))
+			if err := t.limiter.pause(until); err != nil {
+				log.Warnf("Failed to pause the Kamatera API rate limiter: %s", err)
+			}
+		}
+	}
+	return resp, err
+}
+
+// newRateLimitedTransport returns the base transport if rate limiting is disabled
+func (d *Driver) newRateLimitedTransport(base http.RoundTripper) http.RoundTripper {
+	limiter := d.getRateLimiter()
+	if limiter == nil {
+		return base
+	}
+	return &rateLimitedTransport{base: base, limiter: limiter}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitStateTake(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		state  rateLimitState
+		now    time.Time
+		wait   time.Duration
+		tokens float64
+	}{
+		{"first take fills the bucket", rateLimitState{}, now, 0, 9},
+		{"available token", rateLimitState{Tokens: 2, Updated: now}, now, 0, 1},
+		{"empty bucket", rateLimitState{Tokens: 0, Updated: now}, now, 500 * time.Millisecond, 0},
+		{"partial token", rateLimitState{Tokens: 0.5, Updated: now}, now, 250 * time.Millisecond, 0.5},
+		{"refill", rateLimitState{Tokens: 0, Updated: now}, now.Add(time.Second), 0, 1},
+		{"refill is capped by the burst", rateLimitState{Tokens: 0, Updated: now}, now.Add(time.Hour), 0, 9},
+		{"clock moved backwards", rateLimitState{Tokens: 0, Updated: now}, now.Add(-time.Second), 500 * time.Millisecond, 0},
+		{"paused", rateLimitState{Tokens: 10, Updated: now, PausedUntil: now.Add(30 * time.Second)}, now, 30 * time.Second, 10},
+		{"pause ended", rateLimitState{Tokens: 10, Updated: now, PausedUntil: now}, now, 0, 9},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := test.state
+			if wait := state.take(test.now, 2, 10); wait != test.wait {
+				t.Errorf("expected to wait %s, got %s", test.wait, wait)
+			}
+			if state.Tokens != test.tokens {
+				t.Errorf("expected %v tokens, got %v", test.tokens, state.Tokens)
+			}
+		})
+	}
+}
+
+func TestRateLimitStatePause(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var state rateLimitState
+	state.pause(now.Add(time.Minute))
+	state.pause(now.Add(time.Second))
+	if !state.PausedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("an earlier pause shortened the pause: %s", state.PausedUntil)
+	}
+	state.pause(now.Add(2 * time.Minute))
+	if !state.PausedUntil.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("a later pause was ignored: %s", state.PausedUntil)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		until time.Time
+		ok    bool
+	}{
+		{"", time.Time{}, false},
+		{"0", now, true},
+		{"120", now.Add(2 * time.Minute), true},
+		{"-5", time.Time{}, false},
+		{"Mon, 01 Jan 2024 00:05:00 GMT", now.Add(5 * time.Minute), true},
+		{"soon", time.Time{}, false},
+	}
+	for _, test := range tests {
+		until, ok := ParseRetryAfter(test.value, now)
+		if ok != test.ok || !until.Equal(test.until) {
+			t.Errorf("%q: expected %s %v, got %s %v", test.value, test.until, test.ok, until, ok)
+		}
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRateLimitedTransportRetryAfter(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		retryAfter string
+		paused     bool
+	}{
+		{http.StatusTooManyRequests, "60", true},
+		{http.StatusServiceUnavailable, "60", true},
+		{http.StatusTooManyRequests, "", false},
+		{http.StatusOK, "60", false},
+	}
+	for _, test := range tests {
+		limiter := &processRateLimiter{perSecond: 1, burst: 10}
+		transport := &rateLimitedTransport{
+			base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				resp := &http.Response{StatusCode: test.statusCode, Header: http.Header{}}
+				if test.retryAfter != "" {
+					resp.Header.Set("Retry-After", test.retryAfter)
+				}
+				return resp, nil
+			}),
+			limiter: limiter,
+		}
+		req, _ := http.NewRequest("GET", "https://console.kamatera.com/service/server", nil)
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		paused := limiter.state.PausedUntil.After(time.Now().Add(50 * time.Second))
+		if paused != test.paused {
+			t.Errorf("%d %q: expected paused %v, got paused until %s", test.statusCode, test.retryAfter, test.paused, limiter.state.PausedUntil)
+		}
+		if wait, _ := limiter.take(); test.paused && wait <= 0 {
+			t.Errorf("%d %q: the limiter allowed a request while paused", test.statusCode, test.retryAfter)
+		}
+	}
+}
+
+func TestLockFileRemovesStaleLockOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kamatera-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "ratelimit.json.lock")
+	if err := ioutil.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-2 * rateLimitStaleLockTimeout)
+	if err := os.Chtimes(lockPath, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	var holders, maxHolders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockFile(lockPath)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&holders, 1)
+			for {
+				max := atomic.LoadInt32(&maxHolders)
+				if n <= max || atomic.CompareAndSwapInt32(&maxHolders, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if maxHolders != 1 {
+		t.Errorf("expected a single lock holder, got %d", maxHolders)
+	}
+	if _, err := os.Stat(lockPath + ".remove"); !os.IsNotExist(err) {
+		t.Errorf("the stale lock removal lock was not released: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// default timeouts of the SSH bootstrap, in seconds
+const (
+	defaultSSHBootstrapTimeout = 600
+	defaultSSHDialTimeout      = 30
+)
+
+const (
+	defaultSSHRetryInterval = 2 * time.Second
+	// the password may be rejected for a short time while the server initializes
+	sshAuthRetries = 3
+)
+
+func (d *Driver) getSSHRetryInterval() time.Duration {
+	if d.sshRetryInterval <= 0 {
+		return defaultSSHRetryInterval
+	}
+	return d.sshRetryInterval
+}
+
+// getSSHAddress returns the host:port used to connect to the server
+func (d *Driver) getSSHAddress() (string, error) {
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(d.IPAddress, strconv.Itoa(port)), nil
+}
+
+func isSSHAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// copySSHKey connects to the server with the bootstrap credentials, adds the machine SSH key and applies the firewall rules
+// connection errors are retried until the deadline, the command is not retried
+func (d *Driver) copySSHKey(pkey string, deadline time.Time) error {
+	authMethods, err := d.getBootstrapAuthMethods()
+	if err != nil {
+		return err
+	}
+	addr, err := d.getSSHAddress()
+	if err != nil {
+		return err
+	}
+	config := &ssh.ClientConfig{
+		User:            d.GetSSHUsername(),
+		Auth:            authMethods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	dialTimeout := getTimeoutDuration(d.SSHDialTimeout, defaultSSHDialTimeout)
+	log.Debugf("Copying SSH key to the server and performing initialization")
+	authErrors := 0
+	for {
+		log.Debugf("Create/ssh: %s", time.Now())
+		if err := d.sleep(d.getSSHRetryInterval()); err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Timed out waiting for SSH on the Kamatera server (%s)", addr))
+		}
+		client, err := dialSSH(d.getContext(), addr, config, dialTimeout)
+		if err != nil {
+			log.Debugf("SSH failure (%s): %s", time.Now(), err)
+			if isSSHAuthError(err) {
+				authErrors++
+				if authErrors >= sshAuthRetries {
+					return errors.Wrap(err, fmt.Sprintf("SSH authentication to the Kamatera server failed (%s@%s)", config.User, addr))
+				}
+			}
+			continue
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			log.Debugf("SSH session failure (%s): %s", time.Now(), err)
+			client.Close()
+			continue
+		}
+		d.emitEvent(eventSSHReady, "SSH connection established")
+		defer client.Close()
+		defer session.Close()
+		var b bytes.Buffer
+		session.Stdout = &b
+		cmd := fmt.Sprintf("bash -c 'mkdir -p .ssh && echo \"%s\" >> .ssh/authorized_keys'", pkey)
+		log.Debugf("Running ssh cmd: %s", cmd)
+		if err := session.Run(cmd); err != nil {
+			return errors.Wrap(err, "Failed to copy SSH key to the Kamatera server")
+		}
+		if len(d.FirewallAllow) > 0 {
+			log.Infof("Applying firewall rules...")
+			if err := d.applyFirewallRules(client); err != nil {
+				return err
+			}
+		}
+		log.Debugf("SSH Initialization completed successfully (%s)", time.Now())
+		return nil
+	}
+}
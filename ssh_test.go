@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSSHTestDriver(server *fakeSSHServer) *Driver {
+	d := NewDriver()
+	d.IPAddress = server.Host()
+	d.SSHPort = server.Port()
+	d.Password = "secret"
+	d.SSHDialTimeout = 1
+	d.sshRetryInterval = 10 * time.Millisecond
+	return d
+}
+
+func TestCopySSHKey(t *testing.T) {
+	server := newFakeSSHServer(t, fakeSSHScript{Password: "secret"})
+	d := newSSHTestDriver(server)
+	if err := d.copySSHKey("ssh-ed25519 AAAA test", time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	commands := server.Commands()
+	if len(commands) != 1 || !strings.Contains(commands[0], "mkdir -p .ssh") || !strings.Contains(commands[0], `echo "ssh-ed25519 AAAA test" >> .ssh/authorized_keys`) {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+}
+
+func TestCopySSHKeyRetriesRefusedConnections(t *testing.T) {
+	server := newFakeSSHServer(t, fakeSSHScript{Password: "secret", RefuseConnections: 3})
+	d := newSSHTestDriver(server)
+	if err := d.copySSHKey("key", time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if server.Connections() != 4 {
+		t.Errorf("expected 4 connections, got %d", server.Connections())
+	}
+	if len(server.Commands()) != 1 {
+		t.Errorf("expected the command to run once, got %q", server.Commands())
+	}
+}
+
+func TestCopySSHKeyTimeout(t *testing.T) {
+	server := newFakeSSHServer(t, fakeSSHScript{Password: "secret", RefuseConnections: 1000})
+	d := newSSHTestDriver(server)
+	start := time.Now()
+	err := d.copySSHKey("key", time.Now().Add(200*time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "Timed out waiting for SSH") {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timeout took %s", elapsed)
+	}
+	if len(server.Commands()) != 0 {
+		t.Errorf("expected no commands, got %q", server.Commands())
+	}
+}
+
+func TestCopySSHKeyRejectedPassword(t *testing.T) {
+	server := newFakeSSHServer(t, fakeSSHScript{Password: "secret", RejectPassword: true})
+	d := newSSHTestDriver(server)
+	err := d.copySSHKey("key", time.Now().Add(5*time.Second))
+	if err == nil || !strings.Contains(err.Error(), "SSH authentication to the Kamatera server failed") {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+	if server.Connections() != sshAuthRetries {
+		t.Errorf("expected %d connections, got %d", sshAuthRetries, server.Connections())
+	}
+}
+
+func TestCopySSHKeyCommandFailure(t *testing.T) {
+	server := newFakeSSHServer(t, fakeSSHScript{Password: "secret", ExitStatus: 1})
+	d := newSSHTestDriver(server)
+	err := d.copySSHKey("key", time.Now().Add(5*time.Second))
+	if err == nil || !strings.Contains(err.Error(), "Failed to copy SSH key") {
+		t.Fatalf("expected a command error, got %v", err)
+	}
+	// the command is not retried
+	if server.Connections() != 1 || len(server.Commands()) != 1 {
+		t.Errorf("expected 1 connection and command, got %d connections and commands %q", server.Connections(), server.Commands())
+	}
+}
+
+func TestCopySSHKeyFirewall(t *testing.T) {
+	server := newFakeSSHServer(t, fakeSSHScript{Password: "secret"})
+	d := newSSHTestDriver(server)
+	d.FirewallAllow = []string{"tcp:80"}
+	if err := d.copySSHKey("key", time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	commands := server.Commands()
+	if len(commands) != 2 || !strings.Contains(commands[1], "kamatera-firewall.sh") {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/go-resty/resty"
+	"github.com/pkg/errors"
+)
+
+// Telemetry of Kamatera API calls is enabled by setting the KAMATERA_TELEMETRY environment variable
+// to the name of an exporter, optionally followed by :TARGET (e.g. stdout or file:/tmp/kamatera-spans.jsonl)
+// Prometheus-style counters are written in the text exposition format to KAMATERA_METRICS_FILE, if set
+// every plugin process adds its counters to the values in the file, so the counters accumulate over all docker-machine commands
+
+type TelemetrySpan struct {
+	Name            string                 `json:"name"`
+	TraceId         string                 `json:"trace_id"`
+	SpanId          string                 `json:"span_id"`
+	Start           time.Time              `json:"start"`
+	DurationSeconds float64                `json:"duration_seconds"`
+	Attributes      map[string]interface{} `json:"attributes"`
+	Error           string                 `json:"error,omitempty"`
+}
+
+type TelemetryExporter interface {
+	ExportSpan(span TelemetrySpan) error
+}
+
+type TelemetryExporterFactory func(target string) (TelemetryExporter, error)
+
+var telemetryExporterFactories = map[string]TelemetryExporterFactory{
+	"stdout": func(target string) (TelemetryExporter, error) {
+		return &jsonLinesTelemetryExporter{file: os.Stdout}, nil
+	},
+	"file": func(target string) (TelemetryExporter, error) {
+		if target == "" {
+			return nil, errors.New("file telemetry exporter requires a path (file:PATH)")
+		}
+		file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to open telemetry file")
+		}
+		return &jsonLinesTelemetryExporter{file: file}, nil
+	},
+}
+
+// RegisterTelemetryExporter allows to add exporters which can then be selected using KAMATERA_TELEMETRY
+func RegisterTelemetryExporter(name string, factory TelemetryExporterFactory) {
+	telemetryExporterFactories[name] = factory
+}
+
+type jsonLinesTelemetryExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (e *jsonLinesTelemetryExporter) ExportSpan(span TelemetrySpan) error {
+	buf, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(buf, '\n'))
+	return err
+}
+
+type telemetry struct {
+	mu          sync.Mutex
+	exporter    TelemetryExporter
+	metricsFile string
+	traceId     string
+	// counters which were not yet added to the metrics file
+	counters map[string]float64
+}
+
+var (
+	defaultTelemetry     *telemetry
+	defaultTelemetryOnce sync.Once
+)
+
+func getTelemetry() *telemetry {
+	defaultTelemetryOnce.Do(func() {
+		defaultTelemetry = &telemetry{
+			metricsFile: os.Getenv("KAMATERA_METRICS_FILE"),
+			traceId:     randomHex(16),
+			counters:    map[string]float64{},
+		}
+		if config := os.Getenv("KAMATERA_TELEMETRY"); config != "" {
+			parts := strings.SplitN(config, ":", 2)
+			target := ""
+			if len(parts) == 2 {
+				target = parts[1]
+			}
+			factory, ok := telemetryExporterFactories[parts[0]]
+			if !ok {
+				log.Warnf("Unknown KAMATERA_TELEMETRY exporter: %s", parts[0])
+				return
+			}
+			exporter, err := factory(target)
+			if err != nil {
+				log.Warnf("Failed to initialize telemetry exporter: %s", err)
+				return
+			}
+			defaultTelemetry.exporter = exporter
+		}
+	})
+	return defaultTelemetry
+}
+
+func (t *telemetry) enabled() bool {
+	return t.exporter != nil || t.metricsFile != ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func metricKey(name string, labels map[string]string) string {
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", key, labels[key]))
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+func (t *telemetry) addCounter(name string, labels map[string]string, value float64) {
+	t.counters[metricKey(name, labels)] += value
+}
+
+// ParseMetrics parses counters in the text exposition format, comments and invalid lines are ignored
+func ParseMetrics(text string) map[string]float64 {
+	counters := map[string]float64{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		counters[strings.TrimSpace(line[:i])] += value
+	}
+	return counters
+}
+
+// FormatMetrics formats counters in the text exposition format, sorted by name
+func FormatMetrics(counters map[string]float64) string {
+	var keys []string
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s %v\n", key, counters[key])
+	}
+	return b.String()
+}
+
+// writeMetrics adds the counters to the metrics file, should be called with the lock held
+// the file is shared by all plugin processes, it is updated under a lock file and replaced atomically
+func (t *telemetry) writeMetrics() {
+	if t.metricsFile == "" || len(t.counters) == 0 {
+		return
+	}
+	metricsFile := filepath.Clean(t.metricsFile)
+	unlock, err := lockFile(metricsFile + ".lock")
+	if err != nil {
+		log.Debugf("Failed to lock metrics file: %s", err)
+		return
+	}
+	defer unlock()
+	counters := map[string]float64{}
+	if buf, err := ioutil.ReadFile(metricsFile); err == nil {
+		counters = ParseMetrics(string(buf))
+	} else if !os.IsNotExist(err) {
+		log.Debugf("Failed to read metrics file: %s", err)
+		return
+	}
+	for key, value := range t.counters {
+		counters[key] += value
+	}
+	tmpFile := metricsFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(FormatMetrics(counters)), 0644); err != nil {
+		log.Debugf("Failed to write metrics file: %s", err)
+		return
+	}
+	if err := os.Rename(tmpFile, metricsFile); err != nil {
+		log.Debugf("Failed to write metrics file: %s", err)
+		return
+	}
+	t.counters = map[string]float64{}
+}
+
+func (t *telemetry) exportSpan(span TelemetrySpan) {
+	if t.exporter == nil {
+		return
+	}
+	if err := t.exporter.ExportSpan(span); err != nil {
+		log.Debugf("Failed to export telemetry span: %s", err)
+	}
+}
+
+type apiSpan struct {
+	operation  string
+	attempt    int
+	datacenter string
+	start      time.Time
+}
+
+// startAPISpan should be called right before a Kamatera API request, and ended when the response is received
+func (d *Driver) startAPISpan(operation string, attempt int) *apiSpan {
+	return &apiSpan{operation: operation, attempt: attempt, datacenter: d.Datacenter, start: time.Now()}
+}
+
+func (s *apiSpan) end(statusCode int, err error) {
+	t := getTelemetry()
+	if !t.enabled() {
+		return
+	}
+	latency := time.Since(s.start)
+	span := TelemetrySpan{
+		Name:            fmt.Sprintf("kamatera.api.%s", s.operation),
+		TraceId:         t.traceId,
+		SpanId:          randomHex(8),
+		Start:           s.start,
+		DurationSeconds: latency.Seconds(),
+		Attributes: map[string]interface{}{
+			"operation":   s.operation,
+			"attempt":     s.attempt,
+			"status_code": statusCode,
+			"datacenter":  s.datacenter,
+		},
+	}
+	if err != nil {
+		span.Error = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statusLabel := fmt.Sprintf("%d", statusCode)
+	if err != nil {
+		statusLabel = "error"
+	}
+	t.addCounter("kamatera_api_requests_total", map[string]string{"operation": s.operation, "status_code": statusLabel}, 1)
+	t.addCounter("kamatera_api_request_duration_seconds_sum", map[string]string{"operation": s.operation}, latency.Seconds())
+	t.addCounter("kamatera_api_request_duration_seconds_count", map[string]string{"operation": s.operation}, 1)
+	if s.attempt > 1 {
+		t.addCounter("kamatera_api_retries_total", map[string]string{"operation": s.operation}, 1)
+	}
+	t.writeMetrics()
+	t.exportSpan(span)
+}
+
+func (s *apiSpan) endResty(resp *resty.Response, err error) {
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode()
+	}
+	s.end(statusCode, err)
+}
+
+func (s *apiSpan) endHTTP(resp *http.Response, err error) {
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	s.end(statusCode, err)
+}
+
+// recordCreateDuration records the duration of a complete create operation per datacenter
+func (d *Driver) recordCreateDuration(createErr error) {
+	t := getTelemetry()
+	if !t.enabled() || d.eventsStartedAt.IsZero() {
+		return
+	}
+	duration := time.Since(d.eventsStartedAt)
+	result := "success"
+	if createErr != nil {
+		result = "error"
+	}
+	labels := map[string]string{"datacenter": d.Datacenter, "result": result}
+	span := TelemetrySpan{
+		Name:            "kamatera.create",
+		TraceId:         t.traceId,
+		SpanId:          randomHex(8),
+		Start:           d.eventsStartedAt,
+		DurationSeconds: duration.Seconds(),
+		Attributes:      map[string]interface{}{"datacenter": d.Datacenter, "result": result, "command_id": d.CreateServerCommandId},
+	}
+	if createErr != nil {
+		span.Error = createErr.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addCounter("kamatera_create_duration_seconds_sum", labels, duration.Seconds())
+	t.addCounter("kamatera_create_duration_seconds_count", labels, 1)
+	t.writeMetrics()
+	t.exportSpan(span)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteMetricsAccumulates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kamatera-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kamatera.prom")
+	labels := map[string]string{"operation": "server-options", "status_code": "503"}
+	// each telemetry is a separate plugin process
+	for i := 0; i < 3; i++ {
+		tel := &telemetry{metricsFile: path, counters: map[string]float64{}}
+		tel.addCounter("kamatera_api_requests_total", labels, 1)
+		tel.writeMetrics()
+		if len(tel.counters) != 0 {
+			t.Errorf("counters were not reset after writing: %v", tel.counters)
+		}
+	}
+	tel := &telemetry{metricsFile: path, counters: map[string]float64{}}
+	tel.addCounter("kamatera_create_duration_seconds_count", map[string]string{"datacenter": "EU", "result": "success"}, 1)
+	tel.writeMetrics()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		`kamatera_api_requests_total{operation="server-options",status_code="503"}`: 3,
+		`kamatera_create_duration_seconds_count{datacenter="EU",result="success"}`:  1,
+	}
+	if actual := ParseMetrics(string(buf)); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed: %v", err)
+	}
+}
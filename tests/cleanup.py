@@ -11,10 +11,46 @@ if not os.environ.get('KAMATERA_API_CLIENT_ID') or not os.environ.get('KAMATERA_
     exit(1)
 
 
-assert len(sys.argv) == 2, 'usage: cleanup.py "PREFIX"'
-prefix = sys.argv[1]
+USAGE = 'usage: cleanup.py "PREFIX" | cleanup.py --tag KEY=VALUE [--tag KEY=VALUE..]'
 
-print('prefix =', prefix)
+
+# docker-machine store path, used to select machines by tag
+MACHINE_STORAGE_PATH = os.path.expanduser(os.environ.get('MACHINE_STORAGE_PATH', '~/.docker/machine'))
+
+
+def get_tagged_server_names(tags):
+    server_names = set()
+    machines_path = os.path.join(MACHINE_STORAGE_PATH, 'machines')
+    if not os.path.isdir(machines_path):
+        return server_names
+    for machine_name in os.listdir(machines_path):
+        config_path = os.path.join(machines_path, machine_name, 'config.json')
+        if not os.path.exists(config_path): continue
+        with open(config_path) as f:
+            config = json.load(f)
+        if config.get('DriverName') != 'kamatera': continue
+        driver = config.get('Driver', {})
+        machine_tags = driver.get('Tags') or {}
+        if all(machine_tags.get(k) == v for k, v in tags.items()) and driver.get('ServerName'):
+            server_names.add(driver['ServerName'])
+    return server_names
+
+
+if len(sys.argv) == 2:
+    prefix = sys.argv[1]
+    print('prefix =', prefix)
+    server_names = None
+else:
+    assert len(sys.argv) > 2 and len(sys.argv) % 2 == 1, USAGE
+    prefix = None
+    tags = {}
+    for arg, tag in zip(sys.argv[1::2], sys.argv[2::2]):
+        assert arg == '--tag' and '=' in tag, USAGE
+        k, v = tag.split('=', 1)
+        tags[k] = v
+    print('tags =', tags)
+    server_names = get_tagged_server_names(tags)
+    print('server names =', server_names)
 
 while True:
     returncode, output = subprocess.getstatusoutput(
@@ -24,7 +60,8 @@ while True:
     num_errors = 0
     num_deleted = 0
     for server in json.loads(output):
-        if not server['name'].startswith(prefix): continue
+        if prefix is not None and not server['name'].startswith(prefix): continue
+        if server_names is not None and server['name'] not in server_names: continue
         print(server)
         returncode, output = subprocess.getstatusoutput(
             'curl -s -H "AuthClientId: ${KAMATERA_API_CLIENT_ID}" -H "AuthSecret: ${KAMATERA_API_SECRET}" '